@@ -29,8 +29,12 @@ func leafInsert(newNode, old BNode, idx uint16, key, val []byte) {
     nodeAppendRange(newNode, old, idx + 1, idx, old.nkeys() - idx)
 }
 
+// update the value of an existing key, the node keeps the same number of keys
 func leafUpdate(newNode, old BNode, idx uint16, key, val []byte) {
-    // TODO : The function is supposedly similar to leafInsert
+    newNode.setHeader(BNODE_LEAF, old.nkeys())
+    nodeAppendRange(newNode, old, 0, 0, idx)
+    nodeAppendKV(newNode, idx, 0, key, val)
+    nodeAppendRange(newNode, old, idx + 1, idx + 1, old.nkeys() - (idx + 1))
 }
 
 // copy multiple KVs into the position
@@ -93,13 +97,13 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
             leafUpdate(newNode, node, idx, key, val)
         } else {
             // insert it after the position
-            leafInsert(newNode, node, idx, key, val)
+            leafInsert(newNode, node, idx + 1, key, val)
         }
     case BNODE_NODE:
         // internal node, insert it to a child node
         nodeInsert(tree, newNode, node, idx, key, val)
     default:
-        panic("bad node!")
+        panic(errBadNode(node))
     }
     return newNode
 }
@@ -121,7 +125,37 @@ func nodeInsert(tree *BTree, newNode, node BNode, idx uint16, key, val []byte){
 // split a bigger-than-allowed node into two
 // the seconde node always fits on a page
 func nodeSplit2(left, right, old BNode) {
-    
+    assert(old.nkeys() >= 2, "cannot split a node with less than 2 keys")
+
+    // the initial guess
+    nleft := old.nkeys() / 2
+
+    // size of the left half if it takes the first nleft keys
+    leftBytes := func() uint16 {
+        return HEADER + 8 * nleft + 2 * nleft + old.getOffSet(nleft)
+    }
+    // try to fit the left half
+    for leftBytes() > BTREE_PAGE_SIZE {
+        nleft--
+    }
+    assert(nleft >= 1, "left half is empty")
+
+    // size of the right half, the header is counted in both halves
+    rightBytes := func() uint16 {
+        return old.nbytes() - leftBytes() + HEADER
+    }
+    // the right half must fit, the left half is split again if needed
+    for rightBytes() > BTREE_PAGE_SIZE {
+        nleft++
+    }
+    assert(nleft < old.nkeys(), "right half is empty")
+    nright := old.nkeys() - nleft
+
+    left.setHeader(old.btype(), nleft)
+    right.setHeader(old.btype(), nright)
+    nodeAppendRange(left, old, 0, 0, nleft)
+    nodeAppendRange(right, old, 0, nleft, nright)
+    assert(right.nbytes() <= BTREE_PAGE_SIZE, "right half does not fit a page")
 }
 
 // split a node if it's too big. the results are 1~3 nodes
@@ -155,9 +189,12 @@ func nodeReplaceKidN(tree *BTree, newNode, old BNode, idx uint16, kids ...BNode)
     nodeAppendRange(newNode, old, idx + inc, idx + 1, old.nkeys() - (idx + 1))
 }
 
-// The parameters of this function can have better name (esp. merged)
-func nodeReplace2Kid(newNode, old BNode, idx uint16, merged uint64 ,key []byte){
-    // TODO : Compelete the function
+// replace 2 adjacent links (idx and idx + 1) with the merged kid
+func nodeReplace2Kid(newNode, old BNode, idx uint16, merged uint64, key []byte){
+    newNode.setHeader(BNODE_NODE, old.nkeys() - 1)
+    nodeAppendRange(newNode, old, 0, 0, idx)
+    nodeAppendKV(newNode, idx, merged, key, nil)
+    nodeAppendRange(newNode, old, idx + 1, idx + 2, old.nkeys() - (idx + 2))
 }
 
 // 2. B-Tree Deletion
@@ -169,6 +206,10 @@ func leafDelete(newNode BNode, old BNode, idx uint16){
 }
 
 // Recursive Deletion - delete a key from the tree
+// A leaf only shrinks, but an internal node can grow because the separator
+// keys are replaced by the first keys of the updated kids, which may be
+// longer. So the result of an internal node might be bigger than 1 page and
+// the caller is responsible for splitting it, like with treeInsert.
 func treeDelete(tree *BTree, node BNode, key []byte) BNode {
     // where is the key ?
     idx := nodeLookupLE(node, key)
@@ -185,7 +226,7 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
     case BNODE_NODE:
         return nodeDelete(tree, node, idx, key)
     default:
-        panic("bad node!")
+        panic(errBadNode(node))
     }
 }
 
@@ -199,7 +240,8 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
     }
     tree.del(kptr)
 
-    newNode := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+    // the result node - if bigger than 1 page -> splits
+    newNode := BNode{data: make([]byte, 2 * BTREE_PAGE_SIZE)}
     // check for merging
     mergeDir, sibling := shouldMerge(tree, node, updated, idx)
     switch {
@@ -213,9 +255,14 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
         nodeMerge(merged, updated, sibling)
         tree.del(node.getPtr(idx + 1))
         nodeReplace2Kid(newNode, node, idx, tree.new(merged), merged.getKey(0))
-    case mergeDir == 0:
-        assert(updated.nkeys() > 0, "nkeys not greater than 0")
-        nodeReplaceKidN(tree, newNode, node, idx, updated)
+    case mergeDir == 0 && updated.nkeys() == 0:
+        // an empty kid without a sibling, the parent becomes empty too
+        assert(node.nkeys() == 1 && idx == 0, "empty kid has siblings")
+        newNode.setHeader(BNODE_NODE, 0)
+    case mergeDir == 0 && updated.nkeys() > 0:
+        // no merging, the updated kid might need to be split
+        nsplit, splited := nodeSplit3(updated)
+        nodeReplaceKidN(tree, newNode, node, idx, splited[:nsplit]...)
     }
     return newNode
 }
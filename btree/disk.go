@@ -36,24 +36,48 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 
 
 func extendMmap(db *KV, npages int) error {
-    if db.mmap.total >= npages * BTREE_PAGE_SIZE {
-        return nil
+    for db.mmap.total < npages * BTREE_PAGE_SIZE {
+        // double the address space
+        chunk, err := syscall.Mmap(
+            int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
+            syscall.PROT_READ | syscall.PROT_WRITE, syscall.MAP_SHARED)
+        if err != nil {
+            return fmt.Errorf("mmap: %w", err)
+        }
+        db.mmap.total += db.mmap.total
+        db.mmap.chunks = append(db.mmap.chunks, chunk)
     }
+    return nil
+}
 
-    // double the address space
-    chunk, err := syscall.Mmap(
-        int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-        syscall.PROT_READ | syscall.PROT_WRITE, syscall.MAP_SHARED)
+// used by writePages()
+// The file must cover the pages before they are written through the mmap,
+// accessing a mapped page past the end of the file is a SIGBUS. The file
+// grows exponentially so that it's not extended on every update, the pages
+// past the database size are not used until they are appended.
+func extendFile(db *KV, npages int) error {
+    filePages := db.mmap.file / BTREE_PAGE_SIZE
+    if filePages >= npages {
+        return nil
+    }
+    for filePages < npages {
+        inc := filePages / 8
+        if inc < 1 {
+            inc = 1
+        }
+        filePages += inc
+    }
+    fileSize := filePages * BTREE_PAGE_SIZE
+    // fallocate reserves the disk space, so that a full disk is reported
+    // here instead of a SIGBUS when writing the pages
+    err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
+    if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+        // the file system does not support it
+        err = db.fp.Truncate(int64(fileSize))
+    }
     if err != nil {
-        return fmt.Errorf("mmap: %w", err)
+        return fmt.Errorf("fallocate: %w", err)
     }
-    db.mmap.total += db.mmap.total
-    db.mmap.chunks = append(db.mmap.chunks, chunk)
+    db.mmap.file = fileSize
     return nil
-
 }
-
-// used by writePages()
-// func extendFile(db *KV, npages int) error {
-//
-// }
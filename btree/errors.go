@@ -0,0 +1,46 @@
+package btree
+
+import (
+    "errors"
+    "fmt"
+)
+
+// errors returned by the BTree and KV APIs
+var (
+    ErrEmptyKey = errors.New("btree: empty key")
+    ErrKeyTooLarge = fmt.Errorf("btree: key larger than %d bytes", BTREE_MAX_KEY_SIZE)
+    ErrValueTooLarge = fmt.Errorf("btree: value larger than %d bytes", BTREE_MAX_VAL_SIZE)
+    // the data read from the pages does not make sense
+    ErrCorrupt = errors.New("btree: corrupt data")
+)
+
+func checkKey(key []byte) error {
+    if len(key) == 0 {
+        return ErrEmptyKey
+    }
+    if len(key) > BTREE_MAX_KEY_SIZE {
+        return ErrKeyTooLarge
+    }
+    return nil
+}
+
+// a node of an unknown type, raised as a panic by the recursive code
+func errBadNode(node BNode) error {
+    return fmt.Errorf("%w: bad node type %d", ErrCorrupt, node.btype())
+}
+
+// The BTree callbacks and the recursive code cannot return errors, corrupt
+// data found deep inside is raised as a panic and turned back into an error
+// at the API boundary. Any other panic is a broken invariant (a bug), it is
+// not recovered.
+func recoverCorrupt(err *error) {
+    r := recover()
+    if r == nil {
+        return
+    }
+    if e, ok := r.(error); ok && errors.Is(e, ErrCorrupt) {
+        *err = e
+        return
+    }
+    panic(r)
+}
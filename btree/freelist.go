@@ -1,12 +1,20 @@
 package btree
 
+import "encoding/binary"
+
 // Now, B-tree is immutable: every update to the KV store will create new node
 // in the path instead of updating current nodes, leaving some nodes 
 // unreachable. We need to reuse these unreachable nodes from old versions 
 // else DB grows infinitely
 
+// node format:
+// | type | size | checksum | total | next |  pointers |
+// |  2B  |  2B  |    4B    |   8B  |  8B  | size * 8B |
+// total is the number of items in the whole list, only valid in the head node
+// the checksum is shared with BNode, see pageChecksum()
+
 const BNODE_FREE_LIST = 3
-const FREE_LIST_HEADER = 4 + 8 + 8
+const FREE_LIST_HEADER = 8 + 8 + 8
 const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
 
 type FreeList struct {
@@ -19,7 +27,10 @@ type FreeList struct {
 
 // number of items in the list
 func (fl *FreeList) Total() int {
-
+    if fl.head == 0 {
+        return 0
+    }
+    return int(binary.LittleEndian.Uint64(fl.get(fl.head).data[8:]))
 }
 
 // get the nth pointer
@@ -36,50 +47,70 @@ func (fl *FreeList) Get(topn int) uint64 {
 }
 
 // remove pointers and add some new pointers
-func (fl *FreeList) Update(popn int, freed []uint64) {
+// The first skip items stay on top of the list, they are not reused yet
+// since they can still be seen by the readers. The popn items below them are
+// removed, and the freed pointers are added on top of the skipped items.
+func (fl *FreeList) Update(skip int, popn int, freed []uint64) {
 
-    assert(popn <= fl.Total(), "")
+    assert(skip + popn <= fl.Total(), "")
     if popn == 0 && len(freed) == 0 {
         return // nothing to do
     }
 
     // prepare to construct the new list
+    // the nodes are removed from the head until all the skipped and popped
+    // items are gone and there are enough pages to house the new nodes
     total := fl.Total()
-    reuse := []uint64{}
-    for fl.head != 0 && len(reuse) * FREE_LIST_CAP < len(freed) {
+    kept := []uint64{}  // the remaining items of the removed nodes
+    held := []uint64{}  // the skipped items, from the top
+    reuse := []uint64{} // pages for the new nodes
+    // the number of items to be pushed, but the reused pages
+    npush := func() int {
+        return len(kept) + len(held) + len(freed)
+    }
+    for fl.head != 0 && (skip > 0 || popn > 0 || len(reuse) * FREE_LIST_CAP < npush()) {
         node := fl.get(fl.head)
-        freed = append(freed, fl.head) // recycle the node itself
-        if popn >= flnSize(node){
-            // phase 1
-            // remove all pointers in this node
-            popn -= flnSize(node)
-        } else {
-            // phase 2
-            // remove some pointers
-            remain := flnSize(node) - popn
-            popn = 0
-            // reuse pointers from the free-list itself
-            for remain > 0 && len(reuse) * FREE_LIST_CAP < len(freed) + remain {
-
-            }
-            for i := 0; i < remain; i++ {
-                freed = append(freed, flnPtr(node, i))
-            }
+        kept = append(kept, fl.head) // recycle the node itself
+        // the items from the top of the node
+        i := flnSize(node) - 1
+        for ; i >= 0 && skip > 0; i-- {
+            held = append(held, flnPtr(node, i))
+            skip--
+        }
+        for ; i >= 0 && popn > 0; i-- {
+            popn-- // removed
+        }
+        // reuse pointers from the free-list itself
+        for ; i >= 0 && len(reuse) * FREE_LIST_CAP < npush() + i + 1; i-- {
+            reuse = append(reuse, flnPtr(node, i))
+        }
+        for ; i >= 0; i-- {
+            kept = append(kept, flnPtr(node, i))
         }
         // discard the node and move to the next node
         total -= flnSize(node)
         fl.head = flnNext(node)
     }
-    assert(len(reuse) * FREE_LIST_CAP >= len(freed) || fl.head == 0, "")
+    assert(len(reuse) * FREE_LIST_CAP >= npush() || fl.head == 0, "")
 
     // phase 3 - prepend new nodes
-    flPush(fl, freed, reuse)
+    // from the bottom: the kept items, the skipped items, the freed items
+    items := kept
+    for i := len(held) - 1; i >= 0; i-- {
+        items = append(items, held[i])
+    }
+    items = append(items, freed...)
+    flPush(fl, items, reuse)
     // done
-    flnSetTotal(fl.get(fl.head), uint64(total + len(freed)))
+    if fl.head != 0 {
+        flnSetTotal(fl.get(fl.head), uint64(total + len(items)))
+    }
 }
 
 func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
-    for len(freed) > 0 {
+    // taking a pointer for reuse also removes an item, so phase 2 can end
+    // up with one more reused page than needed, it still gets a node
+    for len(freed) > 0 || len(reuse) > 0 {
         newNode := BNode{make([]byte, BTREE_PAGE_SIZE)}
 
         // construct a new node
@@ -101,35 +132,35 @@ func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
             // or append a page to house the new node
             fl.head = fl.new(newNode)
         }
-        
     }
-    assert(len(reuse) == 0, "reuse-length = 0 in flPush")
 }
 
 // Functions for accessing the list node:
 func flnSize(node BNode) int {
-
+    return int(binary.LittleEndian.Uint16(node.data[2:4]))
 }
 
 func flnNext(node BNode) uint64 {
-
+    return binary.LittleEndian.Uint64(node.data[16:])
 }
 
 func flnPtr(node BNode, idx int) uint64 {
-
+    assert(0 <= idx && idx < FREE_LIST_CAP, "idx not within FREE_LIST_CAP")
+    pos := FREE_LIST_HEADER + 8 * idx
+    return binary.LittleEndian.Uint64(node.data[pos:])
 }
 
 func flnSetPtr(node BNode, idx int, ptr uint64) {
-
+    assert(0 <= idx && idx < FREE_LIST_CAP, "idx not within FREE_LIST_CAP")
+    pos := FREE_LIST_HEADER + 8 * idx
+    binary.LittleEndian.PutUint64(node.data[pos:], ptr)
 }
 
 func flnSetHeader(node BNode, size uint16, next uint64) {
-
+    node.setHeader(BNODE_FREE_LIST, size)
+    binary.LittleEndian.PutUint64(node.data[16:], next)
 }
 
 func flnSetTotal(node BNode, total uint64) {
-
+    binary.LittleEndian.PutUint64(node.data[8:], total)
 }
-
-
-
@@ -0,0 +1,147 @@
+package btree
+
+import (
+    "math/rand"
+    "sort"
+    "testing"
+)
+
+// in-memory pages for the free list, page 0 is never used
+type flContainer struct {
+    fl FreeList
+    pages map[uint64]BNode
+    next uint64 // the next page to be appended
+}
+
+func newFlContainer() *flContainer {
+    c := &flContainer{pages: map[uint64]BNode{}, next: 1}
+    c.fl = FreeList{
+        get: func(ptr uint64) BNode {
+            node, ok := c.pages[ptr]
+            assert(ok, "Page not found in get()")
+            return node
+        },
+        new: func(node BNode) uint64 {
+            ptr := c.next
+            c.next++
+            c.pages[ptr] = node
+            return ptr
+        },
+        use: func(ptr uint64, node BNode) {
+            c.pages[ptr] = node
+        },
+    }
+    return c
+}
+
+// all items in the list and the pages holding the list nodes
+func (c *flContainer) items() ([]uint64, []uint64) {
+    items, nodes := []uint64{}, []uint64{}
+    for ptr := c.fl.head; ptr != 0; {
+        node := c.fl.get(ptr)
+        nodes = append(nodes, ptr)
+        for i := 0; i < flnSize(node); i++ {
+            items = append(items, flnPtr(node, i))
+        }
+        ptr = flnNext(node)
+    }
+    return items, nodes
+}
+
+func TestFreeList(t *testing.T) {
+    c := newFlContainer()
+    r := rand.New(rand.NewSource(2))
+    // the pages that are expected to be free
+    free := map[uint64]bool{}
+    // pages handed out by the list and not freed yet
+    used := []uint64{}
+
+    for round := 0; round < 300; round++ {
+        // keep some items on top, like the KV does for the readers
+        skip := 0
+        if round % 2 == 0 {
+            skip = r.Intn(c.fl.Total() + 1)
+        }
+        held := []uint64{}
+        for i := 0; i < skip; i++ {
+            held = append(held, c.fl.Get(i))
+        }
+        // take some pages from the list, like KV.pageNew does
+        popn := r.Intn(c.fl.Total() - skip + 1)
+        if round % 3 == 0 {
+            popn = c.fl.Total() - skip // drain the list
+        }
+        for i := 0; i < popn; i++ {
+            ptr := c.fl.Get(skip + i)
+            if !free[ptr] {
+                t.Fatalf("round %d: got page %d which is not free", round, ptr)
+            }
+            delete(free, ptr)
+            used = append(used, ptr)
+        }
+        // free some pages, new ones or previously used ones
+        freed := []uint64{}
+        for n := r.Intn(2 * FREE_LIST_CAP); n > 0; n-- {
+            if len(used) > 0 && r.Intn(2) == 0 {
+                i := r.Intn(len(used))
+                freed = append(freed, used[i])
+                used[i] = used[len(used) - 1]
+                used = used[:len(used) - 1]
+            } else {
+                freed = append(freed, c.next)
+                c.pages[c.next] = BNode{make([]byte, BTREE_PAGE_SIZE)}
+                c.next++
+            }
+        }
+        nodesBefore := map[uint64]bool{}
+        _, nodes := c.items()
+        for _, ptr := range nodes {
+            nodesBefore[ptr] = true
+        }
+
+        c.fl.Update(skip, popn, freed)
+        for _, ptr := range freed {
+            free[ptr] = true
+        }
+        // the freed items are on top of the skipped items
+        if popn > 0 || len(freed) > 0 {
+            for i, ptr := range freed {
+                if got := c.fl.Get(len(freed) - 1 - i); got != ptr {
+                    t.Fatalf("round %d: item %d is %d, want %d", round, i, got, ptr)
+                }
+            }
+            for i, ptr := range held {
+                if got := c.fl.Get(len(freed) + i); got != ptr {
+                    t.Fatalf("round %d: held item %d is %d, want %d", round, i, got, ptr)
+                }
+            }
+        }
+
+        // the old list nodes are free pages now, unless they hold new nodes
+        items, nodes := c.items()
+        for ptr := range nodesBefore {
+            free[ptr] = true
+        }
+        for _, ptr := range nodes {
+            delete(free, ptr)
+        }
+        if c.fl.Total() != len(items) {
+            t.Fatalf("round %d: total %d, %d items", round, c.fl.Total(), len(items))
+        }
+        got := append([]uint64{}, items...)
+        sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+        want := []uint64{}
+        for ptr := range free {
+            want = append(want, ptr)
+        }
+        sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+        if len(got) != len(want) {
+            t.Fatalf("round %d: %d items, want %d", round, len(got), len(want))
+        }
+        for i := range got {
+            if got[i] != want[i] {
+                t.Fatalf("round %d: item %d is %d, want %d", round, i, got[i], want[i])
+            }
+        }
+    }
+}
@@ -0,0 +1,192 @@
+package btree
+
+import "bytes"
+
+// Retrieving a range of keys (range query)
+// The iterator remembers the path from the root to the current leaf. Moving
+// past the end of a leaf walks back up the path until a node has a next
+// (or previous) kid, and then walks down again to the neighbouring leaf.
+//
+// The tree is copy-on-write, an update never modifies a node in place but
+// creates a new path to a new root. The nodes stored in the path are the
+// ones of the version the iterator was created from, so the iterator keeps
+// reading that version after the tree changes, as long as the pages of the
+// old version are not reused.
+type BIter struct {
+    tree *BTree
+    path []BNode // from root to leaf
+    pos []uint16 // indexes into nodes
+}
+
+// find the closest position that is less than or equal to the input key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+    iter := &BIter{tree: tree}
+    for ptr := tree.root; ptr != 0; {
+        node := tree.get(ptr)
+        idx := nodeLookupLE(node, key)
+        iter.path = append(iter.path, node)
+        iter.pos = append(iter.pos, idx)
+        switch node.btype() {
+        case BNODE_LEAF:
+            ptr = 0
+        case BNODE_NODE:
+            ptr = node.getPtr(idx)
+        default:
+            panic(errBadNode(node))
+        }
+    }
+    return iter
+}
+
+// find the closest position that is greater than or equal to the input key
+func (tree *BTree) SeekGE(key []byte) *BIter {
+    return tree.Seek(key, CMP_GE)
+}
+
+// comparison operators for Seek()
+const (
+    CMP_GE = +3 // >=
+    CMP_GT = +2 // >
+    CMP_LT = -2 // <
+    CMP_LE = -3 // <=
+)
+
+// key cmp ref
+func CmpOK(key []byte, cmp int, ref []byte) bool {
+    r := bytes.Compare(key, ref)
+    switch cmp {
+    case CMP_GE:
+        return r >= 0
+    case CMP_GT:
+        return r > 0
+    case CMP_LT:
+        return r < 0
+    case CMP_LE:
+        return r <= 0
+    default:
+        panic("bad cmp")
+    }
+}
+
+// find the closest position to the input key with the comparison
+// CMP_GE and CMP_GT find the first key after, CMP_LE and CMP_LT find the
+// last key before.
+func (tree *BTree) Seek(key []byte, cmp int) *BIter {
+    iter := tree.SeekLE(key)
+    switch cmp {
+    case CMP_LE:
+    case CMP_LT:
+        if iter.Valid() && bytes.Equal(iterKey(iter), key) {
+            iter.Prev()
+        }
+    case CMP_GE, CMP_GT:
+        // SeekLE() stops at or before the key, or at the dummy key
+        if !iter.Valid() || !CmpOK(iterKey(iter), cmp, key) {
+            iter.Next()
+        }
+    default:
+        panic("bad cmp")
+    }
+    return iter
+}
+
+// the current key without the Valid() check of Deref()
+func iterKey(iter *BIter) []byte {
+    last := len(iter.path) - 1
+    return iter.path[last].getKey(iter.pos[last])
+}
+
+// get the current KV pair
+func (iter *BIter) Deref() ([]byte, []byte) {
+    assert(iter.Valid(), "deref of an invalid iterator")
+    last := len(iter.path) - 1
+    node, idx := iter.path[last], iter.pos[last]
+    return node.getKey(idx), node.getVal(idx)
+}
+
+// precondition of the Deref()
+// The dummy key in the first leaf acts as the position before the first key,
+// and the position after the last key of the last leaf is past the end.
+func (iter *BIter) Valid() bool {
+    if len(iter.path) == 0 {
+        return false // empty tree
+    }
+    last := len(iter.path) - 1
+    node, idx := iter.path[last], iter.pos[last]
+    if idx >= node.nkeys() {
+        return false // past the end
+    }
+    // only the dummy key is empty
+    return len(node.getKey(idx)) > 0
+}
+
+// moving forward
+func (iter *BIter) Next() {
+    if len(iter.path) == 0 {
+        return
+    }
+    last := len(iter.path) - 1
+    if iter.pos[last] >= iter.path[last].nkeys() {
+        return // already past the end
+    }
+    iterNext(iter, last)
+}
+
+// returns false at the end, where nothing below the level is changed
+func iterNext(iter *BIter, level int) bool {
+    if iter.pos[level] + 1 < iter.path[level].nkeys() {
+        iter.pos[level]++ // move within this node
+    } else if level > 0 {
+        if !iterNext(iter, level - 1) { // move to a sibling node
+            return false
+        }
+    } else {
+        // past the last key, only the leaf position is moved so that
+        // Prev() can still come back
+        iter.pos[len(iter.pos) - 1]++
+        return false
+    }
+    if level + 1 < len(iter.pos) {
+        // update the kid node
+        node := iter.path[level]
+        kid := iter.tree.get(node.getPtr(iter.pos[level]))
+        iter.path[level + 1] = kid
+        iter.pos[level + 1] = 0
+    }
+    return true
+}
+
+// moving backward
+func (iter *BIter) Prev() {
+    if len(iter.path) == 0 {
+        return
+    }
+    last := len(iter.path) - 1
+    if iter.pos[last] >= iter.path[last].nkeys() {
+        // come back from past the end
+        iter.pos[last] = iter.path[last].nkeys() - 1
+        return
+    }
+    iterPrev(iter, last)
+}
+
+// returns false at the dummy key, like the above
+func iterPrev(iter *BIter, level int) bool {
+    if iter.pos[level] > 0 {
+        iter.pos[level]-- // move within this node
+    } else if level > 0 {
+        if !iterPrev(iter, level - 1) { // move to a sibling node
+            return false
+        }
+    } else {
+        return false // already at the dummy key, nothing comes before it
+    }
+    if level + 1 < len(iter.pos) {
+        // update the kid node
+        node := iter.path[level]
+        kid := iter.tree.get(node.getPtr(iter.pos[level]))
+        iter.path[level + 1] = kid
+        iter.pos[level + 1] = kid.nkeys() - 1
+    }
+    return true
+}
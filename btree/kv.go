@@ -1,15 +1,46 @@
 package btree
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
+// returned by any use of a KV that is not open, and by the readers, the
+// transactions and the iterators of a KV that was closed after them
+var ErrClosed = errors.New("KV: database is closed")
+
+// the number of KV.Open() calls, each open is a new generation
+var kvOpens atomic.Uint64
+
+// a page read from the file failed the checksum or is out of range
+type ErrCorruptPage struct {
+    Ptr uint64
+}
+
+func (e ErrCorruptPage) Error() string {
+    return fmt.Sprintf("KV: corrupt page %d", e.Ptr)
+}
+
+// errors.Is(err, ErrCorrupt) holds for a corrupt page
+func (e ErrCorruptPage) Is(target error) bool {
+    return target == ErrCorrupt
+}
+
 type KV struct {
     Path string
+    // skip the page checksums, only used when creating a new file
+    NoChecksum bool
     // internals
     fp *os.File
     tree BTree
+    free FreeList
     mmap struct {
         file int // file size, can be larger than database size
         total int // mmap size, can be larger than file size
@@ -18,19 +49,64 @@ type KV struct {
     page struct {
         flushed uint64 // database size in number of pages
 
-        // TO FIX
-        // temp [][]byte // newly allocated pages
-
         // newly allocated or deallocated pages keyed by the pointer
         // nil value denotes a deallocated page
-        nfree int
-        nappend int
+        nhold int // number of pages on top of the free list to be skipped
+        nfree int // number of pages taken from the free list
+        nappend int // number of pages to be appended
         updates map[uint64][]byte
+        // the new pages of this transaction that were deallocated, they are
+        // not seen by anyone else and can be reused right away
+        recycled []uint64
     }
+    // the master page of the last successful flush, used to revert the
+    // in-memory states when a flush fails
+    master []byte
+    // a failed flush might have left a partially written master page
+    failed bool
+    flags uint32 // master page flags
+    // the generation of this open, 0 when closed, see ErrClosed
+    // The readers from an older generation are stale, the pages they refer
+    // to are unmapped.
+    gen atomic.Uint64
+
+    // concurrency control
+    // The transactions and the readers read the snapshots of the past
+    // commits, the commits are serialized, see KVTX and KVReader.
+    writer sync.Mutex // held by a commit, protects the fields above
+    // the keys updated by the recent commits, for the conflict detection
+    history []commitKeys
+    mu sync.Mutex // protects the fields below
+    snap snapshot // the last commit
+    readers map[uint64]int // the number of readers of each version
+    // the pages freed by the recent commits, oldest first, they are on top
+    // of the free list and they are not reused while a reader can see them
+    held []heldPages
+}
+
+// the states a reader needs to read a version of the tree
+type snapshot struct {
+    version uint64 // incremented by each commit
+    root uint64
+    flushed uint64
+    chunks [][]byte
+}
+
+type commitKeys struct {
+    version uint64
+    keys [][]byte // sorted
+}
+
+type heldPages struct {
+    version uint64 // the pages were freed by this commit
+    n int
 }
 
 // 1. open a database
 func (db *KV) Open() error {
+    if db.fp != nil {
+        return errors.New("KV.Open: database is already open")
+    }
     // open or create the DB file
     fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
     if err != nil {
@@ -52,6 +128,12 @@ func (db *KV) Open() error {
     db.tree.get = db.pageGet
     db.tree.new = db.pageNew
     db.tree.del = db.pageDel
+    // Setting up free list callbacks
+    db.free.get = db.pageGet
+    db.free.new = db.pageAppend
+    db.free.use = db.pageUse
+    db.page.updates = map[uint64][]byte{}
+    db.readers = map[uint64]int{}
 
     // read the master page
     err = masterLoad(db)
@@ -59,6 +141,8 @@ func (db *KV) Open() error {
         db.Close()
         return fmt.Errorf("KV.Open : %w", err)
     }
+    snapshotPublish(db)
+    db.gen.Store(kvOpens.Add(1))
 
     // done 
     return nil
@@ -66,32 +150,358 @@ func (db *KV) Open() error {
 
 // 2. close a database
 // cleanups
-func (db *KV) Close() {
+// Updates that were not flushed are discarded, the master page still points
+// to the last commit. The commit in progress is waited for. The mmaps are
+// released, so the readers, the transactions and the iterators must not be
+// in use at the same time, later uses of them and the KV return ErrClosed.
+func (db *KV) Close() error {
+    db.writer.Lock()
+    defer db.writer.Unlock()
+    if db.fp == nil {
+        return ErrClosed
+    }
+    // the readers of this generation are stale from now on
+    db.mu.Lock()
+    db.gen.Store(0)
+    db.mu.Unlock()
+    if db.master != nil {
+        revertPages(db)
+    }
 
+    var err error
+    for _, chunk := range db.mmap.chunks {
+        if e := syscall.Munmap(chunk); e != nil && err == nil {
+            err = fmt.Errorf("munmap: %w", e)
+        }
+    }
+    if e := db.fp.Close(); e != nil && err == nil {
+        err = e
+    }
+
+    db.mu.Lock()
+    kvReset(db)
+    db.mu.Unlock()
+    return err
 }
 
-// FIX: 3. read the db
-// func (db *KV) Get(key []byte) ([]byte, bool) {
-//     return db.tree.Get(key)
-// }
+// reset everything but the path and the locks, so the KV can be opened
+// again, the caller holds both locks
+func kvReset(db *KV) {
+    var zero KV
+    db.NoChecksum = false
+    db.fp = nil
+    db.tree = BTree{}
+    db.free = FreeList{}
+    db.mmap = zero.mmap
+    db.page = zero.page
+    db.master = nil
+    db.failed = false
+    db.flags = 0
+    db.history = nil
+    db.snap = snapshot{}
+    db.readers = nil
+    db.held = nil
+}
+
+// 3. read the db
+// The last commit is read in a read-only transaction, see KVReader. The
+// value is copied, since the page holding it can be reused after that.
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+    r := db.BeginRead()
+    defer r.Close()
+    val, ok, err := r.Get(key)
+    if err != nil || !ok {
+        return nil, false, err
+    }
+    return append([]byte{}, val...), true, nil
+}
+
+// iterator over the KV pairs, see BTree.Seek()
+// A corrupt page stops the iterator, the error is returned by Err(). The
+// iterator is created from a transaction or a reader, and it must not be
+// used after that is done.
+// In a transaction, the snapshot is merged with the pending updates, and
+// the keys seen by the iterator are recorded for the conflict detection.
+type KVIter struct {
+    err error
+    snap treeIter
+    pend treeIter // the pending updates, the tree is nil for a reader
+    deleted map[string]bool // the deleted keys in the pending updates
+    dir int // the direction of the last move, +1 or -1
+    read *keyRange // nil for a reader
+    snapOf *KVReader // the snapshot, stale after the KV is closed
+}
+
+type treeIter struct {
+    tree *BTree
+    iter *BIter
+}
+
+func (ti *treeIter) valid() bool {
+    return ti.tree != nil && ti.iter.Valid()
+}
+
+func (ti *treeIter) key() []byte {
+    key, _ := ti.iter.Deref()
+    return key
+}
+
+func (ti *treeIter) move(dir int) {
+    if ti.tree == nil {
+        return
+    }
+    if dir > 0 {
+        ti.iter.Next()
+    } else {
+        ti.iter.Prev()
+    }
+}
+
+func (ti *treeIter) seek(key []byte, cmp int) {
+    if ti.tree != nil {
+        ti.iter = ti.tree.Seek(key, cmp)
+    }
+}
+
+// the iterator at the current key, the pending one for the same key
+// The current key is the smallest one when moving forward, and the largest
+// one when moving backward.
+func (it *KVIter) cur() *treeIter {
+    switch {
+    case !it.pend.valid():
+        return &it.snap
+    case !it.snap.valid():
+        return &it.pend
+    }
+    r := bytes.Compare(it.pend.key(), it.snap.key())
+    if r == 0 || (r < 0) == (it.dir > 0) {
+        return &it.pend
+    }
+    return &it.snap
+}
+
+// the pages of a stale snapshot are unmapped, the iterator stops
+func kvStale(it *KVIter) bool {
+    if it.err == nil && it.snapOf != nil && it.snapOf.stale() {
+        it.err = ErrClosed
+    }
+    return it.err != nil
+}
+
+func kvSeek(it *KVIter, key []byte, cmp int) *KVIter {
+    if kvStale(it) {
+        return it
+    }
+    defer recoverCorrupt(&it.err)
+    it.dir = +1
+    if cmp < 0 {
+        it.dir = -1
+    }
+    it.snap.seek(key, cmp)
+    it.pend.seek(key, cmp)
+    if it.read != nil {
+        it.read.add(key)
+    }
+    kvSkip(it)
+    return it
+}
+
+// move in the direction and skip the deleted keys
+func kvMove(it *KVIter, dir int) {
+    if kvStale(it) {
+        return
+    }
+    defer recoverCorrupt(&it.err)
+    if !it.Valid() {
+        // both are at either end, they come back together
+        it.dir = dir
+        it.snap.move(dir)
+        it.pend.move(dir)
+    } else if dir != it.dir {
+        // the other iterator can be anywhere, start over from the key
+        key := append([]byte{}, it.cur().key()...)
+        it.dir = dir
+        cmp := CMP_GT
+        if dir < 0 {
+            cmp = CMP_LT
+        }
+        it.snap.seek(key, cmp)
+        it.pend.seek(key, cmp)
+    } else {
+        // move the iterators at the current key
+        key := it.cur().key()
+        if it.pend.valid() && bytes.Equal(it.pend.key(), key) {
+            it.pend.move(dir)
+        }
+        if it.snap.valid() && bytes.Equal(it.snap.key(), key) {
+            it.snap.move(dir)
+        }
+    }
+    kvSkip(it)
+}
+
+// skip the deleted keys and record the keys seen
+func kvSkip(it *KVIter) {
+    for it.pend.valid() && it.cur() == &it.pend && it.deleted[string(it.pend.key())] {
+        key := it.pend.key()
+        if it.snap.valid() && bytes.Equal(it.snap.key(), key) {
+            it.snap.move(it.dir)
+        }
+        it.pend.move(it.dir)
+    }
+    if it.read == nil {
+        return
+    }
+    switch {
+    case it.Valid():
+        it.read.add(it.cur().key())
+    case it.dir > 0:
+        it.read.inf = true // past the end
+    default:
+        it.read.lo = []byte{} // before the first key
+    }
+}
+
+func (it *KVIter) Valid() bool {
+    return !kvStale(it) && (it.snap.valid() || it.pend.valid())
+}
+
+func (it *KVIter) Deref() ([]byte, []byte) {
+    assert(it.Valid(), "deref of an invalid iterator")
+    return it.cur().iter.Deref()
+}
+
+func (it *KVIter) Next() {
+    kvMove(it, +1)
+}
+
+func (it *KVIter) Prev() {
+    kvMove(it, -1)
+}
+
+// the error that stopped the iterator
+func (it *KVIter) Err() error {
+    return it.err
+}
 
 // update the db
+// Each update is a transaction on its own, see KVTX.
 func (db *KV) Set(key, val []byte) error {
-    db.tree.Insert(key, val)
-    return flushPages(db)
+    return db.InsertEx(&InsertReq{Key: key, Val: val, Mode: MODE_UPSERT})
+}
+
+// insert with a mode, see BTree.InsertEx()
+// Nothing is written to the file when the tree is not updated. A conflict
+// with another transaction is retried.
+func (db *KV) InsertEx(req *InsertReq) error {
+    if db.gen.Load() == 0 {
+        return ErrClosed
+    }
+    for {
+        tx := db.Begin()
+        if err := tx.InsertEx(req); err != nil {
+            tx.Abort()
+            return err
+        }
+        if err := tx.Commit(); err != ErrConflict {
+            return err
+        }
+    }
+}
+
+// returns whether the key was added or changed
+func (db *KV) Update(key []byte, val []byte, mode int) (bool, error) {
+    req := &InsertReq{Key: key, Val: val, Mode: mode}
+    err := db.InsertEx(req)
+    return req.Updated, err
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-    deleted := db.tree.Delete(key)
-    return deleted, flushPages(db)
+    if db.gen.Load() == 0 {
+        return false, ErrClosed
+    }
+    for {
+        tx := db.Begin()
+        deleted, err := tx.Del(key)
+        if err != nil {
+            tx.Abort()
+            return false, err
+        }
+        err = tx.Commit()
+        if err == nil {
+            return deleted, nil
+        }
+        if err != ErrConflict {
+            return false, err
+        }
+    }
 }
 
 // persist the newly allocated pages after updates
+// The update is done in 2 phases:
+// 1. write the new pages and fsync, the new pages are either appended or
+//    taken from the free list, so the last committed version is untouched
+// 2. write the master page that points to the new version and fsync
+// A crash before the master page is written leaves the old master page
+// pointing to the old version, the new pages are simply ignored on the
+// next open, so the update is rolled back. The master page is written into
+// the slot of the commit before the last one, so a crash in the middle of it
+// rolls back the same way.
 func flushPages(db *KV) error {
-    if err := writePages(db); err != nil {
+    nfreed := 0
+    for _, page := range db.page.updates {
+        if page == nil {
+            nfreed++
+        }
+    }
+    if db.failed {
+        // the master page on disk is in an unknown state, overwrite it with
+        // the last committed one before new pages overwrite what it might
+        // refer to
+        if err := masterWrite(db, db.master, masterSeq(db.master) + 1); err != nil {
+            revertPages(db)
+            return err
+        }
+        db.failed = false
+    }
+    err := writePages(db)
+    if err == nil {
+        err = syncPages(db)
+    }
+    if err != nil {
+        // the master page might be partially written
+        db.failed = true
+        revertPages(db)
         return err
     }
-    return syncPages(db)
+    db.master = masterData(db)
+
+    // a new version for the readers
+    db.mu.Lock()
+    db.snap.version++
+    if nfreed > 0 {
+        db.held = append(db.held, heldPages{db.snap.version, nfreed})
+    }
+    snapshotPublish(db)
+    db.mu.Unlock()
+    return nil
+}
+
+// the committed states for the new readers
+func snapshotPublish(db *KV) {
+    db.snap.root = db.tree.root
+    db.snap.flushed = db.page.flushed
+    db.snap.chunks = db.mmap.chunks
+}
+
+// revert the in-memory states to the last commit, so that the readers keep
+// working and the next update starts over
+func revertPages(db *KV) {
+    masterApply(db, db.master)
+    db.page.nfree = 0
+    db.page.nappend = 0
+    db.page.updates = map[uint64][]byte{}
+    db.page.recycled = nil
 }
 
 func writePages(db *KV) error {
@@ -102,46 +512,45 @@ func writePages(db *KV) error {
             freed = append(freed, ptr)
         }
     }
+    // the reused pages are removed and the freed pages are added, this can
+    // append pages (or reuse free pages) to hold the list nodes
+    db.free.Update(db.page.nhold, db.page.nfree, freed)
 
     // extend the file & mmap based on requirement
-    npages := int(db.page.flushed) + len(db.page.temp)
-    // if err := extendFile(db, npages); err != nil {
-    //     return err
-    // }
-    if err := extendMmap(db, npages); err != nil {
+    npages := int(db.page.flushed) + db.page.nappend
+    if err := extendFile(db, npages); err != nil {
         return err
     }
-    // copy data to the file
-    for i, page := range db.page.temp {
-        ptr := db.page.flushed + uint64(i)
-        copy(db.pageGet(ptr).data, page)
+    if err := extendMmap(db, npages); err != nil {
+        return err
     }
 
     // copy pages to the file
     for ptr, page := range db.page.updates {
         if page != nil {
-            copy(pageGetMapped(db, ptr).data, page)
+            mapped := mmapPage(db, ptr)
+            copy(mapped, page)
+            if db.flags & MASTER_PAGE_CHECKSUM != 0 {
+                pageStamp(mapped)
+            }
         }
     }
     return nil
 }
 
 func syncPages(db *KV) error {
-    // flush data to the disk. Must be done before updarting the master page
+    // flush data to the disk. Must be done before updating the master page
     if err := db.fp.Sync(); err != nil {
         return fmt.Errorf("fsync: %w", err)
     }
-    db.page.flushed += uint64(len(db.page.temp))
-    db.page.temp = db.page.temp[:0]
+    db.page.flushed += uint64(db.page.nappend)
+    db.page.nfree = 0
+    db.page.nappend = 0
+    db.page.updates = map[uint64][]byte{}
+    db.page.recycled = nil
 
     // update and flush the master page
-    if err := masterStore(db); err != nil {
-        return err
-    }
-    if err := db.fp.Sync(); err != nil {
-        return fmt.Errorf("fsync: %w", err)
-    }
-    return nil
+    return masterStore(db)
 }
 
 
@@ -159,11 +568,14 @@ func syncPages(db *KV) error {
 
 // callback for BTree, allocate a new page
 func (db *KV) pageNew(node BNode) uint64 {
-    assert(len(node.data) <= BTREE_PAGE_SIZE)
+    assert(len(node.data) <= BTREE_PAGE_SIZE, "node-data more than MAX_PAGE_SIZE")
     ptr := uint64(0)
-    if db.page.nfree < db.free.Total() {
-        // reuse a deallocated page
-        ptr = db.free.Get(db.page.nfree)
+    if n := len(db.page.recycled); n > 0 {
+        // reuse a new page of this transaction
+        ptr, db.page.recycled = db.page.recycled[n - 1], db.page.recycled[:n - 1]
+    } else if db.page.nfree < db.free.Total() - db.page.nhold {
+        // reuse a deallocated page that no reader can see
+        ptr = db.free.Get(db.page.nhold + db.page.nfree)
         db.page.nfree++
     } else {
         // append a new page
@@ -177,6 +589,9 @@ func (db *KV) pageNew(node BNode) uint64 {
 
 // callback for BTree to deallocate a page
 func (db *KV) pageDel(ptr uint64) {
+    if page := db.page.updates[ptr]; page != nil {
+        db.page.recycled = append(db.page.recycled, ptr)
+    }
     db.page.updates[ptr] = nil
 }
 
@@ -190,14 +605,38 @@ func (db *KV)pageGet(ptr uint64) BNode {
 
 
 // callback for BTree, dereference a pointer
-// this function was previously pageGet 
+// this function was previously pageGet
+// Only the pages of the last commit are read from the file, anything else
+// comes from a corrupt pointer. The checksum is verified if it's enabled.
 func pageGetMapped(db *KV, ptr uint64) BNode {
+    return pageRead(db.mmap.chunks, db.page.flushed, db.flags, ptr)
+}
+
+// read a page of a version, which has the flushed pages
+// Used by both the writer and the readers.
+func pageRead(chunks [][]byte, flushed uint64, flags uint32, ptr uint64) BNode {
+    if ptr == 0 || ptr >= flushed {
+        panic(ErrCorruptPage{ptr})
+    }
+    page := chunkPage(chunks, ptr)
+    if flags & MASTER_PAGE_CHECKSUM != 0 && !pageVerify(page) {
+        panic(ErrCorruptPage{ptr})
+    }
+    return BNode{page}
+}
+
+// the mmapped page, without any checks
+func mmapPage(db *KV, ptr uint64) []byte {
+    return chunkPage(db.mmap.chunks, ptr)
+}
+
+func chunkPage(chunks [][]byte, ptr uint64) []byte {
     start := uint64(0)
-    for _, chunk := range db.mmap.chunks {
+    for _, chunk := range chunks {
         end := start + uint64(len(chunk)) / BTREE_PAGE_SIZE
         if ptr < end {
             offset := BTREE_PAGE_SIZE * (ptr - start)
-            return BNode{chunk[offset : offset + BTREE_PAGE_SIZE]}
+            return chunk[offset : offset + BTREE_PAGE_SIZE]
         }
         start = end
     }
@@ -206,7 +645,23 @@ func pageGetMapped(db *KV, ptr uint64) BNode {
     panic("bad ptr")
 }
 
-// callback for Freelist, allocate a new page
+// page checksum
+// Both BNode and free list nodes start with | type | size | checksum |, the
+// checksum is the CRC32C of the whole page with the checksum field skipped.
+func pageChecksum(page []byte) uint32 {
+    sum := crc32.Update(0, crc32c, page[:4])
+    return crc32.Update(sum, crc32c, page[8:BTREE_PAGE_SIZE])
+}
+
+func pageStamp(page []byte) {
+    binary.LittleEndian.PutUint32(page[4:8], pageChecksum(page))
+}
+
+func pageVerify(page []byte) bool {
+    return binary.LittleEndian.Uint32(page[4:8]) == pageChecksum(page)
+}
+
+// callback for FreeList, allocate a new page
 func (db *KV) pageAppend(node BNode) uint64 {
     assert(len(node.data) <= BTREE_PAGE_SIZE, "node-data more than MAX_PAGE_SIZE")
     ptr := db.page.flushed + uint64(db.page.nappend)
@@ -215,6 +670,7 @@ func (db *KV) pageAppend(node BNode) uint64 {
     return ptr
 }
 
+// callback for FreeList, reuse a page
 func (db *KV) pageUse(ptr uint64, node BNode) {
     db.page.updates[ptr] = node.data
 }
@@ -0,0 +1,657 @@
+package btree
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func openKV(t *testing.T, path string) *KV {
+    t.Helper()
+    db := &KV{Path: path}
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+// check the KV against the reference map
+func kvVerify(t *testing.T, db *KV, ref map[string]string) {
+    t.Helper()
+    _, kvs, err := treeCheck(&db.tree)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(kvs) != len(ref) {
+        t.Fatalf("%d keys in the tree, want %d", len(kvs), len(ref))
+    }
+    for _, kv := range kvs {
+        if val, ok := ref[string(kv[0])]; !ok || val != string(kv[1]) {
+            t.Fatalf("unexpected KV %q = %q", kv[0], kv[1])
+        }
+    }
+    for key, val := range ref {
+        got, ok, err := db.Get([]byte(key))
+        if err != nil || !ok || string(got) != val {
+            t.Fatalf("Get(%q) = %q, %v; want %q", key, got, ok, val)
+        }
+    }
+}
+
+func TestKVPersist(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    if _, ok, err := db.Get([]byte("k")); ok || err != nil {
+        t.Fatal("found a key in an empty database")
+    }
+
+    ref := map[string]string{}
+    for i := 0; i < 500; i++ {
+        key, val := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+        if err := db.Set([]byte(key), []byte(val)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = val
+    }
+    for i := 0; i < 500; i += 3 {
+        key := fmt.Sprintf("key%d", i)
+        deleted, err := db.Del([]byte(key))
+        if err != nil || !deleted {
+            t.Fatalf("Del(%q) = %v, %v", key, deleted, err)
+        }
+        delete(ref, key)
+    }
+    kvVerify(t, db, ref)
+    db.Close()
+
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+    db.Close()
+}
+
+// overwriting the same keys reuses the freed pages
+func TestKVFreeList(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    ref := map[string]string{}
+    for round := 0; round < 20; round++ {
+        for i := 0; i < 100; i++ {
+            key := fmt.Sprintf("key%d", i)
+            val := fmt.Sprintf("val%d-%d", i, round)
+            if err := db.Set([]byte(key), []byte(val)); err != nil {
+                t.Fatal(err)
+            }
+            ref[key] = val
+        }
+    }
+    kvVerify(t, db, ref)
+
+    // every page is either reachable, in the free list or the master page
+    npages, _, _ := treeCheck(&db.tree)
+    nlist := 0
+    for ptr := db.free.head; ptr != 0; ptr = flnNext(db.pageGet(ptr)) {
+        nlist++
+    }
+    if got := 1 + npages + db.free.Total() + nlist; got != int(db.page.flushed) {
+        t.Fatalf("%d pages accounted for, %d in use", got, db.page.flushed)
+    }
+    if db.page.flushed > 100 {
+        t.Fatalf("database grew to %d pages", db.page.flushed)
+    }
+    db.Close()
+}
+
+// a crash after writing the pages but before the master page
+func TestKVRollback(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    ref := map[string]string{}
+    for i := 0; i < 200; i++ {
+        key := fmt.Sprintf("key%d", i)
+        if err := db.Set([]byte(key), []byte(key)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = key
+    }
+    for i := 0; i < 50; i++ {
+        db.tree.Insert([]byte(fmt.Sprintf("new%d", i)), []byte("lost"))
+        db.tree.Delete([]byte(fmt.Sprintf("key%d", i)))
+    }
+    if err := writePages(db); err != nil {
+        t.Fatal(err)
+    }
+    if err := db.fp.Sync(); err != nil {
+        t.Fatal(err)
+    }
+    // crash
+
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+    // the pages of the lost update are reused
+    for i := 0; i < 50; i++ {
+        key := fmt.Sprintf("again%d", i)
+        if err := db.Set([]byte(key), []byte(key)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = key
+    }
+    db.Close()
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+    db.Close()
+}
+
+// the in-memory states are reverted when a flush fails
+func TestKVFlushError(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    ref := map[string]string{"a": "1", "b": "2"}
+    for key, val := range ref {
+        if err := db.Set([]byte(key), []byte(val)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    fp := db.fp
+    db.fp, _ = os.Open(path) // read-only
+    if err := db.Set([]byte("c"), make([]byte, 3000)); err == nil {
+        t.Fatal("write to a read-only file succeeded")
+    }
+    kvVerify(t, db, ref)
+    db.fp.Close()
+    db.fp = fp
+    // the next update rewrites the master page first
+    if err := db.Set([]byte("c"), []byte("3")); err != nil {
+        t.Fatal(err)
+    }
+    ref["c"] = "3"
+    db.Close()
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+    db.Close()
+}
+
+func TestKVBadMaster(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    for i := 0; i < 10; i++ {
+        if err := db.Set([]byte{byte(i + 1)}, nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+    good := append([]byte{}, db.master...)
+    db.Close()
+
+    // recompute the checksum after changing the fields
+    sum := func(data []byte) []byte {
+        crc := crc32.Checksum(data[:MASTER_SIZE - 4], crc32c)
+        binary.LittleEndian.PutUint32(data[MASTER_SIZE - 4:], crc)
+        return data
+    }
+    cases := []struct {
+        name string
+        change func(data []byte) []byte
+        check func(err error) bool
+    }{
+        {"signature", func(data []byte) []byte {
+            data[0] = 'X'
+            return data
+        }, func(err error) bool { return errors.Is(err, ErrBadSignature) }},
+        {"torn", func(data []byte) []byte {
+            data[25]++ // the root
+            return data
+        }, func(err error) bool { return errors.Is(err, ErrMasterChecksum) }},
+        {"newer", func(data []byte) []byte {
+            binary.LittleEndian.PutUint32(data[16:], MASTER_VERSION + 1)
+            return sum(data)
+        }, func(err error) bool {
+            var verr ErrFormatVersion
+            return errors.As(err, &verr) && verr.Version == MASTER_VERSION + 1
+        }},
+        {"root", func(data []byte) []byte {
+            binary.LittleEndian.PutUint64(data[24:], 1 << 40)
+            return sum(data)
+        }, func(err error) bool { return errors.Is(err, ErrBadMaster) }},
+        {"used", func(data []byte) []byte {
+            binary.LittleEndian.PutUint64(data[32:], 1 << 40)
+            return sum(data)
+        }, func(err error) bool { return errors.Is(err, ErrBadMaster) }},
+        {"flags", func(data []byte) []byte {
+            binary.LittleEndian.PutUint32(data[20:], 1 << 31)
+            return sum(data)
+        }, func(err error) bool { return errors.Is(err, ErrBadMaster) }},
+    }
+    for _, tc := range cases {
+        data := tc.change(append([]byte{}, good...))
+        fp, err := os.OpenFile(path, os.O_RDWR, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        // both slots, or the other one is used
+        for _, off := range []int64{0, MASTER_SLOT} {
+            if _, err = fp.WriteAt(data, off); err != nil {
+                break
+            }
+        }
+        fp.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        db = &KV{Path: path}
+        if err := db.Open(); !tc.check(err) {
+            t.Fatalf("%s: unexpected error %v", tc.name, err)
+        }
+    }
+}
+
+// a torn master page falls back to the other one, the previous commit
+func TestKVTornMaster(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    ref := map[string]string{}
+    for i := 0; i < 100; i++ {
+        key := fmt.Sprintf("key%d", i)
+        if err := db.Set([]byte(key), []byte(key)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = key
+    }
+    if err := db.Set([]byte("key0"), []byte("lost")); err != nil {
+        t.Fatal(err)
+    }
+    if err := db.Set([]byte("lost"), []byte("lost")); err != nil {
+        t.Fatal(err)
+    }
+    seq := masterSeq(db.master)
+    db.Close()
+
+    tear := func(seq uint64) {
+        t.Helper()
+        fp, err := os.OpenFile(path, os.O_RDWR, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer fp.Close()
+        // the second half is from the older write
+        var old [MASTER_SIZE / 2]byte
+        off := int64(seq % 2) * MASTER_SLOT + MASTER_SIZE / 2
+        fp.ReadAt(old[:], int64((seq + 1) % 2) * MASTER_SLOT + MASTER_SIZE / 2)
+        if _, err := fp.WriteAt(old[:], off); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // the last commit is gone, the one before it is in the other slot
+    tear(seq)
+    db = openKV(t, path)
+    if masterSeq(db.master) != seq - 1 {
+        t.Fatalf("opened the master page %d, want %d", masterSeq(db.master), seq - 1)
+    }
+    ref["key0"] = "lost"
+    kvVerify(t, db, ref)
+    // the next commit overwrites the torn one
+    if err := db.Set([]byte("again"), []byte("again")); err != nil {
+        t.Fatal(err)
+    }
+    ref["again"] = "again"
+    db.Close()
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+
+    // and again for the other slot
+    seq = masterSeq(db.master)
+    db.Close()
+    tear(seq)
+    db = openKV(t, path)
+    delete(ref, "again")
+    kvVerify(t, db, ref)
+    db.Close()
+
+    // both bad
+    fp, err := os.OpenFile(path, os.O_RDWR, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    fp.WriteAt([]byte{0xff}, int64((seq - 1) % 2) * MASTER_SLOT + 25)
+    fp.Close()
+    if err := (&KV{Path: path}).Open(); !errors.Is(err, ErrMasterChecksum) {
+        t.Fatalf("got %v", err)
+    }
+}
+
+func TestKVClose(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    if err := db.Set([]byte("k"), []byte("v")); err != nil {
+        t.Fatal(err)
+    }
+    // pending updates are not committed by Close
+    db.tree.Insert([]byte("pending"), []byte("v"))
+    if err := db.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    if _, _, err := db.Get([]byte("k")); err != ErrClosed {
+        t.Fatalf("Get after Close: %v", err)
+    }
+    if err := db.Set([]byte("k"), nil); err != ErrClosed {
+        t.Fatalf("Set after Close: %v", err)
+    }
+    if _, err := db.Del([]byte("k")); err != ErrClosed {
+        t.Fatalf("Del after Close: %v", err)
+    }
+    if err := db.Close(); err != ErrClosed {
+        t.Fatalf("Close after Close: %v", err)
+    }
+
+    // the same handle can be opened again
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    kvVerify(t, db, map[string]string{"k": "v"})
+    db.Close()
+
+    // no leaks when opening and closing many times
+    for i := 0; i < 2000; i++ {
+        if err := db.Open(); err != nil {
+            t.Fatal(err)
+        }
+        if err := db.Close(); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+// the readers, the transactions and the iterators fail after Close
+func TestKVCloseOpenReaders(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    for i := 0; i < 100; i++ {
+        if err := db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    r := db.BeginRead()
+    it := r.Seek(nil, CMP_GE)
+    tx := db.Begin()
+    txIt := tx.Seek([]byte("k50"), CMP_GE)
+    if !it.Valid() || !txIt.Valid() {
+        t.Fatal("invalid iterators")
+    }
+    if err := db.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, iter := range []*KVIter{it, txIt} {
+        iter.Next()
+        if iter.Valid() || iter.Err() != ErrClosed {
+            t.Fatalf("iterator after Close: %v", iter.Err())
+        }
+        iter.Prev()
+        if iter.Valid() {
+            t.Fatal("valid iterator after Close")
+        }
+    }
+    if _, _, err := r.Get([]byte("k00")); err != ErrClosed {
+        t.Fatalf("Get after Close: %v", err)
+    }
+    if it := r.Seek(nil, CMP_GE); it.Valid() || it.Err() != ErrClosed {
+        t.Fatalf("Seek after Close: %v", it.Err())
+    }
+    if _, _, err := tx.Get([]byte("k00")); err != ErrClosed {
+        t.Fatalf("Get after Close: %v", err)
+    }
+    if err := tx.Set([]byte("k00"), []byte("x")); err != ErrClosed {
+        t.Fatalf("Set after Close: %v", err)
+    }
+    if err := tx.Commit(); err != ErrClosed {
+        t.Fatalf("Commit after Close: %v", err)
+    }
+    r.Close()
+
+    // the same for a KV opened again after them
+    r = openKV(t, path).BeginRead()
+    r.db.Close()
+    r.db.Open()
+    defer r.db.Close()
+    if _, _, err := r.Get([]byte("k00")); err != ErrClosed {
+        t.Fatalf("Get after reopen: %v", err)
+    }
+    // not counted by the KV opened again
+    r2 := r.db.BeginRead()
+    r.Close()
+    if len(r.db.readers) != 1 || r.db.readers[r2.version] != 1 {
+        t.Fatalf("readers %v", r.db.readers)
+    }
+    r2.Close()
+    if len(r.db.readers) != 0 {
+        t.Fatalf("readers %v", r.db.readers)
+    }
+}
+
+// a Close waits for the commit in progress
+func TestKVCloseCommit(t *testing.T) {
+    db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+    done := make(chan error)
+    go func() {
+        for i := 0; ; i++ {
+            if err := db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+                done <- err
+                return
+            }
+        }
+    }()
+    db.Close()
+    if err := <-done; err != ErrClosed {
+        t.Fatalf("got %v", err)
+    }
+}
+
+// flip a bit in every page of the tree and the free list
+func TestKVCorruptPage(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    ref := map[string]string{}
+    for i := 0; i < 300; i++ {
+        key := fmt.Sprintf("key%d", i)
+        if err := db.Set([]byte(key), []byte(key)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = key
+    }
+    used := db.page.flushed
+    inTree := map[uint64]bool{}
+    var walk func(ptr uint64)
+    walk = func(ptr uint64) {
+        inTree[ptr] = true
+        if node := db.tree.get(ptr); node.btype() == BNODE_NODE {
+            for i := uint16(0); i < node.nkeys(); i++ {
+                walk(node.getPtr(i))
+            }
+        }
+    }
+    walk(db.tree.root)
+    db.Close()
+
+    for ptr := uint64(1); ptr < used; ptr++ {
+        fp, err := os.OpenFile(path, os.O_RDWR, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        flip := func() {
+            var b [1]byte
+            off := int64(ptr * BTREE_PAGE_SIZE + 100)
+            fp.ReadAt(b[:], off)
+            b[0] ^= 0x10
+            fp.WriteAt(b[:], off)
+        }
+        flip()
+
+        db = openKV(t, path)
+        corrupt := 0
+        for key, val := range ref {
+            got, ok, err := db.Get([]byte(key))
+            var cerr ErrCorruptPage
+            if errors.As(err, &cerr) {
+                corrupt++
+                continue
+            }
+            if err != nil || !ok || string(got) != val {
+                t.Fatalf("page %d: Get(%q) = %q, %v, %v", ptr, key, got, ok, err)
+            }
+        }
+        // the update either fails or does not touch the corrupt page
+        if err := db.Set([]byte("key0"), []byte("key0")); err != nil {
+            var cerr ErrCorruptPage
+            if !errors.As(err, &cerr) {
+                t.Fatalf("page %d: unexpected error %v", ptr, err)
+            }
+            corrupt++
+        }
+        // a free page is never read, every tree page is read by the Gets
+        if inTree[ptr] && corrupt == 0 {
+            t.Fatalf("page %d: corruption not detected", ptr)
+        }
+        db.Close()
+        flip() // restore
+        fp.Close()
+    }
+}
+
+func TestKVSeek(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    for i := 0; i < 500; i++ {
+        key := fmt.Sprintf("key%03d", i)
+        if err := db.Set([]byte(key), []byte(key)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    r := db.BeginRead()
+    n := 0
+    for it := r.Seek([]byte("key100"), CMP_GT); it.Valid(); it.Next() {
+        key, val := it.Deref()
+        if want := fmt.Sprintf("key%03d", 101 + n); string(key) != want || string(val) != want {
+            t.Fatalf("got %q = %q, want %q", key, val, want)
+        }
+        n++
+    }
+    if n != 399 {
+        t.Fatalf("got %d keys", n)
+    }
+    r.Close()
+
+    // a corrupt leaf stops the iterator with an error
+    root := db.tree.get(db.tree.root)
+    leaf := root.getPtr(root.nkeys() - 1)
+    db.Close()
+    fp, err := os.OpenFile(path, os.O_RDWR, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    fp.WriteAt([]byte{0xff}, int64(leaf * BTREE_PAGE_SIZE + 100))
+    fp.Close()
+    db = openKV(t, path)
+    r = db.BeginRead()
+    it := r.Seek([]byte(""), CMP_GE)
+    for it.Valid() {
+        it.Next()
+    }
+    var cerr ErrCorruptPage
+    if !errors.As(it.Err(), &cerr) || cerr.Ptr != leaf {
+        t.Fatalf("got %v, want a corrupt page %d", it.Err(), leaf)
+    }
+    r.Close()
+    if it := r.Seek(nil, CMP_GE); it.Valid() || it.Err() != ErrTxDone {
+        t.Fatalf("got %v on a closed reader", it.Err())
+    }
+    r = db.BeginRead()
+    db.Close()
+    if it := r.Seek(nil, CMP_GE); it.Valid() || it.Err() != ErrClosed {
+        t.Fatalf("got %v on a closed KV", it.Err())
+    }
+    r.Close()
+}
+
+func TestKVNoChecksum(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := &KV{Path: path, NoChecksum: true}
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    if err := db.Set([]byte("k"), []byte("v")); err != nil {
+        t.Fatal(err)
+    }
+    if sum := binary.LittleEndian.Uint32(mmapPage(db, db.tree.root)[4:]); sum != 0 {
+        t.Fatalf("checksum %#x stamped while disabled", sum)
+    }
+    db.Close()
+    // the setting is kept in the file
+    db = openKV(t, path)
+    if db.flags & MASTER_PAGE_CHECKSUM != 0 {
+        t.Fatal("checksum enabled on an existing file")
+    }
+    kvVerify(t, db, map[string]string{"k": "v"})
+    db.Close()
+}
+
+func TestKVErrors(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    defer db.Close()
+    if err := db.Set([]byte("k"), []byte("v")); err != nil {
+        t.Fatal(err)
+    }
+    used := db.page.flushed
+    if err := db.Set(nil, nil); err != ErrEmptyKey {
+        t.Fatalf("Set of an empty key: %v", err)
+    }
+    if err := db.Set(make([]byte, BTREE_MAX_KEY_SIZE + 1), nil); err != ErrKeyTooLarge {
+        t.Fatalf("Set of a large key: %v", err)
+    }
+    if err := db.Set([]byte("k"), make([]byte, BTREE_MAX_VAL_SIZE + 1)); err != ErrValueTooLarge {
+        t.Fatalf("Set of a large value: %v", err)
+    }
+    if _, err := db.Del(nil); err != ErrEmptyKey {
+        t.Fatalf("Del of an empty key: %v", err)
+    }
+    if deleted, err := db.Del([]byte("missing")); deleted || err != nil {
+        t.Fatalf("Del of a missing key: %v, %v", deleted, err)
+    }
+    if db.page.flushed != used || len(db.page.updates) != 0 {
+        t.Fatal("pages written by failed updates")
+    }
+    kvVerify(t, db, map[string]string{"k": "v"})
+}
+
+func TestKVUpdate(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    defer db.Close()
+    if updated, err := db.Update([]byte("k"), []byte("v"), MODE_UPDATE_ONLY); updated || err != nil {
+        t.Fatalf("update of a missing key: %v, %v", updated, err)
+    }
+    if db.page.flushed != 1 {
+        t.Fatal("pages written by a no-op")
+    }
+    if updated, err := db.Update([]byte("k"), []byte("v"), MODE_INSERT_ONLY); !updated || err != nil {
+        t.Fatalf("insert of a new key: %v, %v", updated, err)
+    }
+    master := string(db.master)
+    if updated, err := db.Update([]byte("k"), []byte("x"), MODE_INSERT_ONLY); updated || err != nil {
+        t.Fatalf("insert of an existing key: %v, %v", updated, err)
+    }
+    if updated, err := db.Update([]byte("k"), []byte("v"), MODE_UPSERT); updated || err != nil {
+        t.Fatalf("upsert of the same value: %v, %v", updated, err)
+    }
+    if string(db.master) != master {
+        t.Fatal("the master page is changed by a no-op")
+    }
+    req := &InsertReq{Key: []byte("k"), Val: []byte("w"), Mode: MODE_UPDATE_ONLY}
+    if err := db.InsertEx(req); err != nil || !req.Updated || req.Added || string(req.Old) != "v" {
+        t.Fatalf("update of an existing key: %+v, %v", req, err)
+    }
+    kvVerify(t, db, map[string]string{"k": "w"})
+}
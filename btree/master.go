@@ -5,6 +5,7 @@ import(
     "fmt"
     "bytes"
     "errors"
+    "hash/crc32"
 )
 
 // Signature
@@ -12,43 +13,166 @@ const DB_SIG = "RiteshDB"
 
 // master page format
 // it contains the pointer to the root and other important bits
-// | sig | btree_root | page_used |
-// | 16B |     8B     |     8B    |
+// | sig | version | flags | btree_root | page_used | free_list | seq | checksum |
+// | 16B |    4B   |   4B  |     8B     |     8B    |     8B    |  8B |    4B    |
+// The checksum is the CRC32C of everything before it.
+const MASTER_SIZE = 60
+// the format version written by this code
+// version 1 had no flags and a 4B page header without the page checksum
+// version 2 had a single master page without the sequence number
+const MASTER_VERSION = 3
 
+// The first page holds 2 master pages, they are written in turns by the
+// sequence number, so a torn write leaves the other one (the last commit)
+// intact. The slots are in different disk sectors.
+const MASTER_SLOT = BTREE_PAGE_SIZE / 2
+
+// master page flags, fixed when the file is created
+const (
+    MASTER_PAGE_CHECKSUM = 1 << 0 // pages carry a checksum in the header
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// errors from opening a database file
+var (
+    ErrBadSignature = errors.New("KV: not a database file")
+    ErrMasterChecksum = errors.New("KV: master page checksum mismatch")
+    ErrBadMaster = errors.New("KV: bad master page")
+)
+
+// the file is written in a version of the format that cannot be read
+type ErrFormatVersion struct {
+    Version uint32
+}
+
+func (e ErrFormatVersion) Error() string {
+    return fmt.Sprintf("KV: unsupported format version %d (supported: %d)",
+        e.Version, MASTER_VERSION)
+}
+
+// read the master page when opening the database
+// The newest of the 2 master pages that are valid is used. A master page that
+// was torn by a crash fails the checksum, the other one is the last commit,
+// and the pages written after it are not reachable from it, which rolls them
+// back.
 func masterLoad(db *KV) error {
     if db.mmap.file == 0 {
         // empty file, the master page will be created on the first write
         db.page.flushed = 1 // reserved for the master page
+        if !db.NoChecksum {
+            db.flags |= MASTER_PAGE_CHECKSUM
+        }
+        db.master = masterData(db)
         return nil
     }
-    data := db.mmap.chunks[0]
-    root := binary.LittleEndian.Uint64(data[16:])
-    used := binary.LittleEndian.Uint64(data[24:])
+    var data []byte
+    errs := [2]error{}
+    for i := range errs {
+        slot := db.mmap.chunks[0][i * MASTER_SLOT:][:MASTER_SIZE]
+        errs[i] = masterCheck(db, slot)
+        var verr ErrFormatVersion
+        if errors.As(errs[i], &verr) {
+            return errs[i] // not ours to fall back from
+        }
+        if errs[i] == nil && (data == nil || masterSeq(slot) > masterSeq(data)) {
+            data = slot
+        }
+    }
+    if data == nil {
+        // the second slot is empty until the first commit
+        if errors.Is(errs[0], ErrBadSignature) {
+            return errs[1]
+        }
+        return errs[0]
+    }
+    masterApply(db, data)
+    db.flags = binary.LittleEndian.Uint32(data[20:])
+    db.master = append([]byte{}, data...)
+    return nil
+}
 
-    // verify the page
-    if !bytes.Equal([]byte(DB_SIG), data[:16]) {
-        return errors.New("Bad signature.")
+// verify a master page
+func masterCheck(db *KV, data []byte) error {
+    if !bytes.Equal([]byte(DB_SIG), bytes.TrimRight(data[:16], "\x00")) {
+        return ErrBadSignature
     }
-    bad := !(1 <= used && used <= uint64(db.map.file / BTREE_PAGE_SIZE))
-    bad = bad || !(9 < root && root < used)
-    if bad {
-        return errors.New("Bad master page")
+    // the version comes first, a newer format may place the rest elsewhere
+    version := binary.LittleEndian.Uint32(data[16:])
+    if version != MASTER_VERSION {
+        return ErrFormatVersion{version}
+    }
+    sum := binary.LittleEndian.Uint32(data[MASTER_SIZE - 4:])
+    if sum != crc32.Checksum(data[:MASTER_SIZE - 4], crc32c) {
+        return ErrMasterChecksum // torn or corrupted
+    }
+
+    flags := binary.LittleEndian.Uint32(data[20:])
+    root := binary.LittleEndian.Uint64(data[24:])
+    used := binary.LittleEndian.Uint64(data[32:])
+    free := binary.LittleEndian.Uint64(data[40:])
+    if flags &^ MASTER_PAGE_CHECKSUM != 0 {
+        return fmt.Errorf("%w: unknown flags %#x", ErrBadMaster, flags)
+    }
+    // the pages in use must be in the file, the root and the free list
+    // must be in use (0 means empty)
+    if !(1 <= used && used <= uint64(db.mmap.file / BTREE_PAGE_SIZE)) {
+        return fmt.Errorf("%w: %d pages used, %d in the file",
+            ErrBadMaster, used, db.mmap.file / BTREE_PAGE_SIZE)
+    }
+    if !(root < used) || !(free < used) || (root != 0 && root == free) {
+        return fmt.Errorf("%w: root %d, free list %d, %d pages used",
+            ErrBadMaster, root, free, used)
     }
-    db.tree.root = root
-    db.page.flushed = used
     return nil
 }
 
-func masterStore(db *KV) error {
-    var data [32]byte
+// the sequence number of a master page, 0 for none
+func masterSeq(data []byte) uint64 {
+    if data == nil {
+        return 0
+    }
+    return binary.LittleEndian.Uint64(data[48:])
+}
+
+// the master page of the in-memory states
+func masterData(db *KV) []byte {
+    var data [MASTER_SIZE]byte
     copy(data[:16], []byte(DB_SIG))
-    binary.LittleEndian.PutUint64(data[16:], db.tree.root)
-    binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+    binary.LittleEndian.PutUint32(data[16:], MASTER_VERSION)
+    binary.LittleEndian.PutUint32(data[20:], db.flags)
+    binary.LittleEndian.PutUint64(data[24:], db.tree.root)
+    binary.LittleEndian.PutUint64(data[32:], db.page.flushed)
+    binary.LittleEndian.PutUint64(data[40:], db.free.head)
+    // the next one after the last commit
+    binary.LittleEndian.PutUint64(data[48:], masterSeq(db.master) + 1)
+    sum := crc32.Checksum(data[:MASTER_SIZE - 4], crc32c)
+    binary.LittleEndian.PutUint32(data[MASTER_SIZE - 4:], sum)
+    return data[:]
+}
+
+// set the in-memory states from a master page
+func masterApply(db *KV, data []byte) {
+    db.tree.root = binary.LittleEndian.Uint64(data[24:])
+    db.page.flushed = binary.LittleEndian.Uint64(data[32:])
+    db.free.head = binary.LittleEndian.Uint64(data[40:])
+}
+
+func masterStore(db *KV) error {
+    data := masterData(db)
+    return masterWrite(db, data, masterSeq(data))
+}
+
+// write and flush the master page into the slot of the sequence number seq
+func masterWrite(db *KV, data []byte, seq uint64) error {
     // Updating the page via mmap is not atomic
     // Alternate : pwrite() system call
-    _, err := db.fp.WriteAt(data[:], 0)
+    _, err := db.fp.WriteAt(data, int64(seq % 2) * MASTER_SLOT)
     if err != nil {
         return fmt.Errorf("write master page: %w", err)
     }
+    if err := db.fp.Sync(); err != nil {
+        return fmt.Errorf("fsync: %w", err)
+    }
     return nil
 }
@@ -1,6 +1,10 @@
 package btree
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
 
 type BNode struct {
     data []byte // to be dumped to disk
@@ -8,6 +12,7 @@ type BNode struct {
     // The []byte slice consists for the following
     // type - 2B (input - uint16)
     // nkeys - 2B (input - uint16)
+    // checksum - 4B (input - uint32) (set when the page is written to disk)
     // pointers - n * 8B (input - uint64) (n = nkeys)
     // offsets - n * 2B (input - ) (n = nkeys)
     // KV - ...
@@ -56,7 +61,7 @@ func (node BNode) getPtr(idx uint16) uint64 {
     // A pointer is uint64 type in Go. idx is where the pointer is stored in []byte
     // We are storing all pointers in the []byte slice. 
     // Space alloc : nkeys * 8B
-    // idx starts from 0. So first pointer position starts from HEADER = [4:]
+    // idx starts from 0. So first pointer position starts from HEADER = [8:]
     // LittleEndian.Uint64() starts at zero-th position of given byte-slice and 
     // traverses 8 bytes worth of data. Then converts to uint64 and returns
     assert(idx < node.nkeys(), "idx not less than nkeys") 
@@ -129,7 +134,7 @@ func (node BNode) kvPos(idx uint16) uint16 {
     // *values = KV pair
 
     // For returning kvPos:
-    // Cross of the HEADER - type, keys-list = 4B
+    // Cross of the HEADER - type, keys-list, checksum = 8B
     // Cross over the POINTERS-LIST - nkeys() * 8B
     // Cross over the OFFSET-LIST - nkeys() * 2B
     // Add in the offset - xB
@@ -197,23 +202,17 @@ type BTree struct {
     del     func(uint64)
 }
 
-const HEADER = 4
+const HEADER = 8 // type, nkeys and checksum
 const BTREE_PAGE_SIZE = 4096    // page size is defined to be 4KiB
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
 
 // Function to check is max_node_size remains smaller than page size
 func init() {
+    // a node with a single KV of the maximum size must fit in a page,
+    // otherwise nodeSplit2 cannot always produce a right half that fits
     node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-    assert(node1max > BTREE_MAX_KEY_SIZE, "Node size exceeds allowed limit")
-
-    // if node1max > BTREE_PAGE_SIZE {
-        // Handle error: Node size exceeds page size limit
-        // assertion did not work properly
-
-        // panic("Node size exceeds allowed limit")
-        // assert.True(node1max <= BTREE_PAGE_SIZE)
-    // }
+    assert(node1max <= BTREE_PAGE_SIZE, "Node size exceeds allowed limit")
 }
 
 func assert(condition bool, msg string){
@@ -222,30 +221,69 @@ func assert(condition bool, msg string){
     }
 }
 
-func (tree *BTree) Delete(key []byte) bool {
-    assert(len(key) != 0, "Key length is 0")
-    assert(len(key) <= BTREE_MAX_KEY_SIZE, "Key-length exceeded MAX_SIZE")
+// point query: walk from the root down to the leaf that may hold the key.
+// nodeLookupLE picks the child whose range covers the key at every level,
+// the dummy key in the first leaf guarantees that such a child exists.
+// The returned slice refers to the page itself and must not be modified.
+// Corrupt data is raised as a panic of ErrCorrupt, see recoverCorrupt().
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+    // the empty key is reserved for the dummy key and never stored
+    if tree.root == 0 || len(key) == 0 {
+        return nil, false
+    }
+    node := tree.get(tree.root)
+    for {
+        idx := nodeLookupLE(node, key)
+        switch node.btype() {
+        case BNODE_LEAF:
+            // leaf, node.getKey(idx) <= key
+            if !bytes.Equal(key, node.getKey(idx)) {
+                return nil, false // not found
+            }
+            return node.getVal(idx), true
+        case BNODE_NODE:
+            // internal node, descend into the kid
+            node = tree.get(node.getPtr(idx))
+        default:
+            panic(errBadNode(node))
+        }
+    }
+}
+
+// delete a key, returns whether the key was found
+func (tree *BTree) Delete(key []byte) (deleted bool, err error) {
+    if err := checkKey(key); err != nil {
+        return false, err
+    }
     if tree.root == 0 {
-        return false
+        return false, nil
     }
+    defer recoverCorrupt(&err)
     updated := treeDelete(tree, tree.get(tree.root), key)
     if len(updated.data) == 0 {
-        return false // not found
+        return false, nil // not found
     }
     tree.del(tree.root)
     if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
         // remove a level
         tree.root = updated.getPtr(0)
     } else {
-        tree.root = tree.new(updated)
+        treeGrow(tree, updated)
     }
-    return true
+    return true, nil
 }
 
-func (tree *BTree) Insert(key []byte, val []byte) {
-    assert(len(key) != 0, "key-length not equal to 0")
-    assert(len(key) <= BTREE_MAX_KEY_SIZE, "Key-length exceeded MAX_SIZE")
-    assert(len(val) <= BTREE_MAX_VAL_SIZE, "value-length exceeded MAX_SIZE")
+// insert a new key or update an existing key
+// Nothing is changed if the key or the value is invalid. If corrupt data is
+// found halfway, some pages might be already deallocated, the caller should
+// discard the pending updates.
+func (tree *BTree) Insert(key []byte, val []byte) (err error) {
+    if err := checkKey(key); err != nil {
+        return err
+    }
+    if len(val) > BTREE_MAX_VAL_SIZE {
+        return ErrValueTooLarge
+    }
 
     if tree.root == 0 {
         // create the first node
@@ -256,12 +294,99 @@ func (tree *BTree) Insert(key []byte, val []byte) {
         nodeAppendKV(root, 0, 0, nil, nil)
         nodeAppendKV(root, 1, 0, key, val)
         tree.root = tree.new(root)
-        return
+        return nil
     }
+    defer recoverCorrupt(&err)
     node := tree.get(tree.root)
     tree.del(tree.root)
 
     node = treeInsert(tree, node, key, val)
+    treeGrow(tree, node)
+    return nil
+}
+
+// operation modes
+const(
+    MODE_UPSERT      = 0 // insert or replace
+    MODE_UPDATE_ONLY = 1 // update existing keys
+    MODE_INSERT_ONLY = 2 // only add new keys
+)
+
+type InsertReq struct {
+    // out
+    Added   bool   // added a new key
+    Updated bool   // added a new key or changed the value of an old key
+    Old     []byte // the old value, nil if the key did not exist
+    // in
+    Key     []byte
+    Val     []byte
+    Mode    int
+}
+
+// insert with a mode
+// The tree is not touched (no pages allocated or deallocated) when the mode
+// makes it a no-op, or when the new value is the same as the old one.
+func (tree *BTree) InsertEx(req *InsertReq) (err error) {
+    if err := insertCheck(req); err != nil {
+        return err
+    }
+    old, exists, err := tree.getChecked(req.Key)
+    if err != nil {
+        return err
+    }
+    if !insertDecide(req, old, exists) {
+        return nil
+    }
+    if err := tree.Insert(req.Key, req.Val); err != nil {
+        return err
+    }
+    req.Added, req.Updated = !exists, true
+    return nil
+}
+
+// validate the request and reset the outputs
+func insertCheck(req *InsertReq) error {
+    if err := checkKey(req.Key); err != nil {
+        return err
+    }
+    if len(req.Val) > BTREE_MAX_VAL_SIZE {
+        return ErrValueTooLarge
+    }
+    if req.Mode != MODE_UPSERT && req.Mode != MODE_UPDATE_ONLY &&
+        req.Mode != MODE_INSERT_ONLY {
+        return fmt.Errorf("btree: bad insert mode %d", req.Mode)
+    }
+    req.Added, req.Updated, req.Old = false, false, nil
+    return nil
+}
+
+// whether the key is to be updated, given the old value
+func insertDecide(req *InsertReq, old []byte, exists bool) bool {
+    if exists {
+        // the page holding it can be reused after the update
+        req.Old = append([]byte{}, old...)
+    }
+    switch {
+    case exists && req.Mode == MODE_INSERT_ONLY:
+        return false
+    case !exists && req.Mode == MODE_UPDATE_ONLY:
+        return false
+    case exists && bytes.Equal(old, req.Val):
+        return false
+    }
+    return true
+}
+
+// Get() with corrupt data returned as an error
+func (tree *BTree) getChecked(key []byte) (val []byte, ok bool, err error) {
+    defer recoverCorrupt(&err)
+    val, ok = tree.Get(key)
+    return val, ok, nil
+}
+
+// set the updated root, the root is split if it's too big and a new level
+// is added on top of the split nodes
+func treeGrow(tree *BTree, node BNode) {
     nsplit, splitted := nodeSplit3(node)
     if nsplit > 1 {
         root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
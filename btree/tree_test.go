@@ -1,6 +1,12 @@
 package btree
 
 import(
+    "bytes"
+    "errors"
+    "fmt"
+    "math/rand"
+    "sort"
+    "testing"
     "unsafe"
 )
 
@@ -43,13 +49,605 @@ func newContainer() *Container {
 }
 
 func (c *Container) add(key string, val string){
-    c.tree.Insert([]byte(key), []byte(val))
+    err := c.tree.Insert([]byte(key), []byte(val))
+    assert(err == nil, "Insert failed")
     c.ref[key] = val
 }
 
 func (c *Container) del(key string) bool {
     delete(c.ref, key)
-    return c.tree.Delete([]byte(key))
+    deleted, err := c.tree.Delete([]byte(key))
+    assert(err == nil, "Delete failed")
+    return deleted
 }
 
-// Test cases to be written
+func (c *Container) get(key string) (string, bool) {
+    val, ok := c.tree.Get([]byte(key))
+    return string(val), ok
+}
+
+// Structural validator: walks the whole tree and checks that
+// - every node fits in a page and has a known type
+// - the keys in each node are sorted and unique
+// - the first key of each kid equals its separator key in the parent
+// - the keys of each kid are in the range given by the parent
+// - all leaves are at the same depth
+// - the first leaf starts with the dummy key
+// It returns the number of reachable pages and the KVs in order.
+func treeCheck(tree *BTree) (int, [][2][]byte, error) {
+    if tree.root == 0 {
+        return 0, nil, nil
+    }
+    npages := 0
+    kvs := [][2][]byte{}
+    leafDepth := -1
+    // [lo, hi) is the key range of the node, hi == nil means unbounded
+    var check func(ptr uint64, depth int, lo, hi []byte) error
+    check = func(ptr uint64, depth int, lo, hi []byte) error {
+        npages++
+        node := tree.get(ptr)
+        if node.btype() != BNODE_LEAF && node.btype() != BNODE_NODE {
+            return fmt.Errorf("page %d: bad node type %d", ptr, node.btype())
+        }
+        if node.nkeys() == 0 {
+            return fmt.Errorf("page %d: empty node", ptr)
+        }
+        if node.nbytes() > BTREE_PAGE_SIZE {
+            return fmt.Errorf("page %d: %d bytes", ptr, node.nbytes())
+        }
+        for i := uint16(0); i < node.nkeys(); i++ {
+            key := node.getKey(i)
+            if i == 0 && !bytes.Equal(key, lo) {
+                return fmt.Errorf("page %d: first key %q, want %q", ptr, key, lo)
+            }
+            if i > 0 && bytes.Compare(node.getKey(i - 1), key) >= 0 {
+                return fmt.Errorf("page %d: keys %d and %d not in order", ptr, i - 1, i)
+            }
+            if hi != nil && bytes.Compare(key, hi) >= 0 {
+                return fmt.Errorf("page %d: key %q out of range %q", ptr, key, hi)
+            }
+        }
+        if node.btype() == BNODE_LEAF {
+            if leafDepth < 0 {
+                leafDepth = depth
+            } else if leafDepth != depth {
+                return fmt.Errorf("page %d: leaf at depth %d, want %d", ptr, depth, leafDepth)
+            }
+            for i := uint16(0); i < node.nkeys(); i++ {
+                kvs = append(kvs, [2][]byte{node.getKey(i), node.getVal(i)})
+            }
+            return nil
+        }
+        for i := uint16(0); i < node.nkeys(); i++ {
+            khi := hi
+            if i + 1 < node.nkeys() {
+                khi = node.getKey(i + 1)
+            }
+            if err := check(node.getPtr(i), depth + 1, node.getKey(i), khi); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if err := check(tree.root, 0, []byte{}, nil); err != nil {
+        return 0, nil, err
+    }
+    if len(kvs[0][0]) != 0 {
+        return 0, nil, errors.New("missing the dummy key")
+    }
+    return npages, kvs[1:], nil
+}
+
+// validate the tree and compare it with the reference map
+func (c *Container) verify(t *testing.T) {
+    t.Helper()
+    npages, kvs, err := treeCheck(&c.tree)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if npages != len(c.pages) {
+        t.Fatalf("%d pages reachable, %d allocated", npages, len(c.pages))
+    }
+    keys := []string{}
+    for key := range c.ref {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    if len(keys) != len(kvs) {
+        t.Fatalf("%d keys in the tree, want %d", len(kvs), len(keys))
+    }
+    for i, key := range keys {
+        if string(kvs[i][0]) != key || string(kvs[i][1]) != c.ref[key] {
+            t.Fatalf("key %d: got %q, want %q", i, kvs[i][0], key)
+        }
+    }
+}
+
+func TestGet(t *testing.T) {
+    c := newContainer()
+    if _, ok := c.get("k"); ok {
+        t.Fatal("found a key in an empty tree")
+    }
+
+    for i := 0; i < 50; i++ {
+        c.add(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d", i))
+    }
+    for key, val := range c.ref {
+        got, ok := c.get(key)
+        if !ok || got != val {
+            t.Fatalf("get(%q) = %q, %v; want %q", key, got, ok, val)
+        }
+    }
+    for _, key := range []string{"", "key", "key0000", "key050", "zzz"} {
+        if _, ok := c.get(key); ok {
+            t.Fatalf("get(%q) found a missing key", key)
+        }
+    }
+
+    c.del("key010")
+    if _, ok := c.get("key010"); ok {
+        t.Fatal("deleted key is still visible")
+    }
+}
+
+// build a 2-level tree by hand from sorted keys, n keys per leaf
+func buildTree(c *Container, keys []string, n int) {
+    leaves := []BNode{}
+    for i := 0; i < len(keys); i += n {
+        chunk := keys[i:min(i + n, len(keys))]
+        leaf := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+        idx := uint16(0)
+        if i == 0 {
+            leaf.setHeader(BNODE_LEAF, uint16(len(chunk) + 1))
+            nodeAppendKV(leaf, 0, 0, nil, nil) // the dummy key
+            idx++
+        } else {
+            leaf.setHeader(BNODE_LEAF, uint16(len(chunk)))
+        }
+        for _, key := range chunk {
+            nodeAppendKV(leaf, idx, 0, []byte(key), []byte("v" + key))
+            c.ref[key] = "v" + key
+            idx++
+        }
+        leaves = append(leaves, leaf)
+    }
+    root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+    root.setHeader(BNODE_NODE, uint16(len(leaves)))
+    for i, leaf := range leaves {
+        nodeAppendKV(root, uint16(i), c.tree.new(leaf), leaf.getKey(0), nil)
+    }
+    c.tree.root = c.tree.new(root)
+}
+
+func iterKeys(iter *BIter, forward bool) []string {
+    keys := []string{}
+    for iter.Valid() {
+        key, val := iter.Deref()
+        if string(val) != "v" + string(key) {
+            panic("bad value")
+        }
+        keys = append(keys, string(key))
+        if forward {
+            iter.Next()
+        } else {
+            iter.Prev()
+        }
+    }
+    return keys
+}
+
+func TestIter(t *testing.T) {
+    c := newContainer()
+    if iter := c.tree.SeekGE([]byte("a")); iter.Valid() {
+        t.Fatal("valid iterator on an empty tree")
+    }
+
+    keys := []string{}
+    for i := 0; i < 40; i++ {
+        keys = append(keys, fmt.Sprintf("k%02d", 2 * i)) // even numbers only
+    }
+    buildTree(c, keys, 7)
+
+    check := func(got []string, want []string) {
+        t.Helper()
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Fatalf("got %v, want %v", got, want)
+        }
+    }
+    check(iterKeys(c.tree.SeekGE([]byte("")), true), keys)
+    check(iterKeys(c.tree.SeekGE([]byte("k13")), true), keys[7:])
+    check(iterKeys(c.tree.SeekGE([]byte("k14")), true), keys[7:])
+    check(iterKeys(c.tree.SeekLE([]byte("k15")), true), keys[7:])
+    check(iterKeys(c.tree.SeekGE([]byte("z")), true), []string{})
+    check(iterKeys(c.tree.SeekLE([]byte("a")), true), []string{})
+
+    rev := []string{}
+    for i := len(keys) - 1; i >= 0; i-- {
+        rev = append(rev, keys[i])
+    }
+    check(iterKeys(c.tree.SeekLE([]byte("z")), false), rev)
+    check(iterKeys(c.tree.SeekLE([]byte("k29")), false), rev[25:])
+    check(iterKeys(c.tree.SeekGE([]byte("a")), false), rev[39:])
+
+    // moving past either end and coming back
+    iter := c.tree.SeekLE([]byte("z"))
+    iter.Next()
+    iter.Next()
+    iter.Prev()
+    if key, _ := iter.Deref(); string(key) != keys[len(keys) - 1] {
+        t.Fatalf("got %q after coming back from the end", key)
+    }
+    iter = c.tree.SeekGE([]byte(""))
+    iter.Prev()
+    iter.Prev()
+    if iter.Valid() {
+        t.Fatal("valid iterator before the first key")
+    }
+    iter.Next()
+    if key, _ := iter.Deref(); string(key) != keys[0] {
+        t.Fatalf("got %q after coming back from the start", key)
+    }
+}
+
+// the number of levels from the root to the leaves
+func treeDepth(tree *BTree) int {
+    depth := 0
+    for ptr := tree.root; ptr != 0; depth++ {
+        node := tree.get(ptr)
+        ptr = 0
+        if node.btype() == BNODE_NODE {
+            ptr = node.getPtr(0)
+        }
+    }
+    return depth
+}
+
+// moving past the ends of a tree with inner nodes below the root
+func TestIterDeep(t *testing.T) {
+    c := newContainer()
+    keys := []string{}
+    for i := 0; i < 1000; i++ {
+        key := fmt.Sprintf("k%04d", i)
+        c.add(key, key + string(bytes.Repeat([]byte{'v'}, 2000)))
+        keys = append(keys, key)
+    }
+    if depth := treeDepth(&c.tree); depth < 3 {
+        t.Fatalf("depth %d", depth)
+    }
+    walk := func(iter *BIter, forward bool) []string {
+        got := []string{}
+        for ; iter.Valid() && len(got) <= len(keys); {
+            key, val := iter.Deref()
+            if !bytes.HasPrefix(val, key) {
+                t.Fatalf("bad value for %q", key)
+            }
+            got = append(got, string(key))
+            if forward {
+                iter.Next()
+            } else {
+                iter.Prev()
+            }
+        }
+        return got
+    }
+    check := func(got []string, want []string) {
+        t.Helper()
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Fatalf("got %d keys %v, want %d keys", len(got), got[:min(len(got), 5)], len(want))
+        }
+    }
+    rev := []string{}
+    for i := len(keys) - 1; i >= 0; i-- {
+        rev = append(rev, keys[i])
+    }
+    check(walk(c.tree.SeekGE([]byte("")), true), keys)
+    check(walk(c.tree.SeekGE([]byte("k0990")), true), keys[990:])
+    check(walk(c.tree.SeekLE([]byte("z")), false), rev)
+    check(walk(c.tree.SeekLE([]byte("k0009")), false), rev[990:])
+
+    // past either end and back
+    iter := c.tree.SeekLE([]byte("z"))
+    iter.Next()
+    iter.Next()
+    if iter.Valid() {
+        t.Fatal("valid iterator after the last key")
+    }
+    iter.Prev()
+    if key, _ := iter.Deref(); string(key) != keys[len(keys) - 1] {
+        t.Fatalf("got %q after coming back from the end", key)
+    }
+    iter = c.tree.SeekGE([]byte(""))
+    iter.Prev()
+    iter.Prev()
+    if iter.Valid() {
+        t.Fatal("valid iterator before the first key")
+    }
+    iter.Next()
+    if key, _ := iter.Deref(); string(key) != keys[0] {
+        t.Fatalf("got %q after coming back from the start", key)
+    }
+}
+
+func TestSeek(t *testing.T) {
+    c := newContainer()
+    for _, cmp := range []int{CMP_GE, CMP_GT, CMP_LT, CMP_LE} {
+        if c.tree.Seek([]byte("a"), cmp).Valid() {
+            t.Fatal("valid iterator on an empty tree")
+        }
+    }
+    keys := []string{}
+    for i := 0; i < 40; i++ {
+        keys = append(keys, fmt.Sprintf("k%02d", 2 * i))
+    }
+    buildTree(c, keys, 7)
+
+    cases := []struct {
+        key  string
+        cmp  int
+        want string // "" for an invalid iterator
+    }{
+        {"k14", CMP_GE, "k14"}, {"k14", CMP_GT, "k16"},
+        {"k14", CMP_LE, "k14"}, {"k14", CMP_LT, "k12"},
+        {"k15", CMP_GE, "k16"}, {"k15", CMP_GT, "k16"},
+        {"k15", CMP_LE, "k14"}, {"k15", CMP_LT, "k14"},
+        // across the leaves, 7 keys each
+        {"k13", CMP_GT, "k14"}, {"k14", CMP_LT, "k12"},
+        {"", CMP_GE, "k00"}, {"a", CMP_GT, "k00"},
+        {"k00", CMP_LT, ""}, {"a", CMP_LE, ""},
+        {"k78", CMP_GT, ""}, {"z", CMP_GE, ""},
+        {"z", CMP_LE, "k78"}, {"k78", CMP_LT, "k76"},
+    }
+    for _, tc := range cases {
+        iter := c.tree.Seek([]byte(tc.key), tc.cmp)
+        got := ""
+        if iter.Valid() {
+            key, _ := iter.Deref()
+            got = string(key)
+        }
+        if got != tc.want {
+            t.Fatalf("Seek(%q, %d) = %q, want %q", tc.key, tc.cmp, got, tc.want)
+        }
+        if got != "" && !CmpOK([]byte(got), tc.cmp, []byte(tc.key)) {
+            t.Fatalf("CmpOK(%q, %d, %q) is false", got, tc.cmp, tc.key)
+        }
+    }
+}
+
+func TestIterSnapshot(t *testing.T) {
+    c := newContainer()
+    // keep the retired pages readable, like the KV does until they are
+    // reused, so that the old version stays intact
+    retired := map[uint64]BNode{}
+    get, del := c.tree.get, c.tree.del
+    c.tree.get = func(ptr uint64) BNode {
+        if node, ok := retired[ptr]; ok {
+            return node
+        }
+        return get(ptr)
+    }
+    c.tree.del = func(ptr uint64) {
+        retired[ptr] = c.pages[ptr]
+        del(ptr)
+    }
+
+    keys := []string{}
+    for i := 0; i < 30; i++ {
+        keys = append(keys, fmt.Sprintf("k%02d", 2 * i))
+    }
+    buildTree(c, keys, 5)
+
+    iter := c.tree.SeekGE([]byte("k10"))
+    // change the tree while iterating
+    c.add("k11", "vk11")
+    c.del("k20")
+    c.add("k40", "vk40") // rewrite the leaf
+    c.del("k58")
+    got := iterKeys(iter, true)
+    if fmt.Sprint(got) != fmt.Sprint(keys[5:]) {
+        t.Fatalf("got %v, want %v", got, keys[5:])
+    }
+    // a new iterator sees the new version
+    got = iterKeys(c.tree.SeekGE([]byte("k10")), true)
+    if len(got) != len(keys[5:]) - 1 || got[1] != "k11" {
+        t.Fatalf("unexpected new version %v", got)
+    }
+}
+
+// a leaf of up to 2 pages splits into 1~3 nodes that each fit a page
+func TestNodeSplit3(t *testing.T) {
+    big := func(c byte, n int) []byte {
+        return bytes.Repeat([]byte{c}, n)
+    }
+    cases := []struct {
+        kvs [][2][]byte
+        nsplit uint16
+    }{
+        {[][2][]byte{{big('a', 1000), big('x', 3000)}}, 1},
+        {[][2][]byte{{big('a', 1000), big('x', 3000)}, {big('b', 1000), big('y', 3000)}}, 2},
+        // the left half is still too big after the first split
+        {[][2][]byte{
+            {big('a', 10), big('x', 1500)},
+            {big('b', 1000), big('y', 3000)},
+            {big('c', 1000), big('z', 1500)},
+        }, 3},
+    }
+    for i, tc := range cases {
+        old := BNode{data: make([]byte, 2 * BTREE_PAGE_SIZE)}
+        old.setHeader(BNODE_LEAF, uint16(len(tc.kvs) + 1))
+        nodeAppendKV(old, 0, 0, nil, nil)
+        for j, kv := range tc.kvs {
+            nodeAppendKV(old, uint16(j + 1), 0, kv[0], kv[1])
+        }
+        nsplit, splitted := nodeSplit3(old)
+        if nsplit != tc.nsplit {
+            t.Fatalf("case %d: %d nodes, want %d", i, nsplit, tc.nsplit)
+        }
+        j := uint16(0)
+        for _, node := range splitted[:nsplit] {
+            if node.nbytes() > BTREE_PAGE_SIZE || len(node.data) != BTREE_PAGE_SIZE {
+                t.Fatalf("case %d: node does not fit a page", i)
+            }
+            for k := uint16(0); k < node.nkeys(); k++ {
+                if !bytes.Equal(node.getKey(k), old.getKey(j)) ||
+                    !bytes.Equal(node.getVal(k), old.getVal(j)) {
+                    t.Fatalf("case %d: KV %d changed", i, j)
+                }
+                j++
+            }
+        }
+        if j != old.nkeys() {
+            t.Fatalf("case %d: %d keys after split, want %d", i, j, old.nkeys())
+        }
+    }
+}
+
+func TestInsertDelete(t *testing.T) {
+    c := newContainer()
+    r := rand.New(rand.NewSource(1))
+    keys := []string{}
+    randKey := func() string {
+        n := 1 + r.Intn(BTREE_MAX_KEY_SIZE)
+        if r.Intn(4) > 0 {
+            n = 1 + r.Intn(20)
+        }
+        return fmt.Sprintf("%0*d", n, r.Intn(100000))
+    }
+    randVal := func() string {
+        n := r.Intn(BTREE_MAX_VAL_SIZE + 1)
+        if r.Intn(4) > 0 {
+            n = r.Intn(50)
+        }
+        return string(bytes.Repeat([]byte{byte('a' + r.Intn(26))}, n))
+    }
+
+    // insert, including updates of existing keys
+    for i := 0; i < 2000; i++ {
+        key := randKey()
+        if i % 10 == 0 && len(keys) > 0 {
+            key = keys[r.Intn(len(keys))]
+        } else if _, ok := c.ref[key]; !ok {
+            keys = append(keys, key)
+        }
+        c.add(key, randVal())
+        c.verify(t)
+    }
+    for i := 0; i < 100; i++ {
+        key := keys[r.Intn(len(keys))]
+        if got, ok := c.get(key); !ok || got != c.ref[key] {
+            t.Fatalf("get(%q) failed", key)
+        }
+    }
+
+    // delete everything, including missing keys
+    r.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+    for i, key := range keys {
+        if !c.del(key) {
+            t.Fatalf("del(%q) not found", key)
+        }
+        if c.del(key) {
+            t.Fatalf("del(%q) found twice", key)
+        }
+        if i % 7 == 0 || len(c.ref) < 100 {
+            c.verify(t)
+        }
+    }
+    c.verify(t)
+    if len(c.pages) != 1 {
+        t.Fatalf("%d pages left in an empty tree", len(c.pages))
+    }
+}
+
+// only maximum sized KVs, every leaf holds a single key
+func TestLargeKV(t *testing.T) {
+    c := newContainer()
+    val := string(bytes.Repeat([]byte{'v'}, BTREE_MAX_VAL_SIZE))
+    for i := 0; i < 300; i++ {
+        key := fmt.Sprintf("%0*d", BTREE_MAX_KEY_SIZE, (i * 7919) % 300)
+        c.add(key, val)
+        c.verify(t)
+    }
+    for i := 0; i < 300; i++ {
+        key := fmt.Sprintf("%0*d", BTREE_MAX_KEY_SIZE, i)
+        if !c.del(key) {
+            t.Fatalf("del %d not found", i)
+        }
+        c.verify(t)
+    }
+}
+
+func TestInvalidKV(t *testing.T) {
+    c := newContainer()
+    c.add("k", "v")
+    big := make([]byte, BTREE_MAX_VAL_SIZE + 1)
+    cases := []struct {
+        key, val []byte
+        err error
+    }{
+        {nil, nil, ErrEmptyKey},
+        {[]byte{}, []byte("v"), ErrEmptyKey},
+        {big[:BTREE_MAX_KEY_SIZE + 1], nil, ErrKeyTooLarge},
+        {[]byte("k"), big, ErrValueTooLarge},
+    }
+    for _, tc := range cases {
+        if err := c.tree.Insert(tc.key, tc.val); err != tc.err {
+            t.Fatalf("Insert(%d, %d bytes) = %v, want %v", len(tc.key), len(tc.val), err, tc.err)
+        }
+        if tc.err == ErrValueTooLarge {
+            continue
+        }
+        if _, err := c.tree.Delete(tc.key); err != tc.err {
+            t.Fatalf("Delete(%d bytes) = %v, want %v", len(tc.key), err, tc.err)
+        }
+    }
+    c.verify(t)
+
+    // a node of an unknown type
+    root := c.tree.get(c.tree.root)
+    root.setHeader(7, root.nkeys())
+    if err := c.tree.Insert([]byte("x"), nil); !errors.Is(err, ErrCorrupt) {
+        t.Fatalf("Insert into a corrupt tree: %v", err)
+    }
+}
+
+func TestInsertEx(t *testing.T) {
+    c := newContainer()
+    for i := 0; i < 100; i++ {
+        c.add(fmt.Sprintf("key%d", i), "old")
+    }
+    cases := []struct {
+        key, val string
+        mode int
+        added, updated bool
+        old string
+    }{
+        {"key1", "new", MODE_UPSERT, false, true, "old"},
+        {"key1", "new", MODE_UPSERT, false, false, "new"}, // same value
+        {"a", "new", MODE_UPSERT, true, true, ""},
+        {"key2", "new", MODE_INSERT_ONLY, false, false, "old"},
+        {"b", "new", MODE_INSERT_ONLY, true, true, ""},
+        {"key3", "new", MODE_UPDATE_ONLY, false, true, "old"},
+        {"c", "new", MODE_UPDATE_ONLY, false, false, ""},
+    }
+    for _, tc := range cases {
+        root := c.tree.root
+        req := &InsertReq{Key: []byte(tc.key), Val: []byte(tc.val), Mode: tc.mode}
+        if err := c.tree.InsertEx(req); err != nil {
+            t.Fatal(err)
+        }
+        if req.Added != tc.added || req.Updated != tc.updated || string(req.Old) != tc.old {
+            t.Fatalf("%+v: got added %v, updated %v, old %q", tc, req.Added, req.Updated, req.Old)
+        }
+        if tc.old == "" && req.Old != nil {
+            t.Fatalf("%+v: old value of a new key", tc)
+        }
+        if req.Updated {
+            c.ref[tc.key] = tc.val
+        } else if c.tree.root != root {
+            t.Fatalf("%+v: the tree is changed by a no-op", tc)
+        }
+        c.verify(t)
+    }
+    if err := c.tree.InsertEx(&InsertReq{Key: []byte("k"), Mode: 9}); err == nil {
+        t.Fatal("bad mode accepted")
+    }
+}
@@ -0,0 +1,398 @@
+package btree
+
+import (
+    "bytes"
+    "errors"
+    "sort"
+)
+
+// returned by any use of a transaction after Commit() or Abort()
+var ErrTxDone = errors.New("KV: transaction is done")
+
+// returned by Commit() when the keys read by the transaction were updated
+// by another commit, the caller can retry the whole transaction
+var ErrConflict = errors.New("KV: transaction conflict")
+
+// KV transaction
+// A transaction reads the snapshot of the last commit when it began, and its
+// updates build up in an in-memory tree, the pending updates are merged with
+// the snapshot for its own reads. Nothing is written until the commit, which
+// applies the pending updates to the latest tree and writes them with a
+// single master page switch, so either all or none of the updates reach the
+// disk. Aborting simply throws away the pending updates.
+// Any number of transactions can run at the same time, only the commits are
+// serialized. The keys and the ranges read by a transaction are recorded,
+// and the commit fails with ErrConflict if any of them was updated by a
+// commit after the snapshot (optimistic concurrency control).
+type KVTX struct {
+    db *KV
+    snap *KVReader // the snapshot of the last commit
+    pending BTree // the updates, the deleted keys have an empty value
+    deleted map[string]bool
+    reads []*keyRange // for the conflict detection
+    done bool
+}
+
+// a range of keys read by a transaction, a point read is a range of 1 key
+type keyRange struct {
+    lo []byte // empty for the start of the key space
+    hi []byte
+    inf bool // to the end of the key space
+}
+
+// extend the range to the key
+func (r *keyRange) add(key []byte) {
+    if r.lo == nil || (len(r.lo) > 0 && bytes.Compare(key, r.lo) < 0) {
+        r.lo = append([]byte{}, key...)
+    }
+    if r.hi == nil || bytes.Compare(key, r.hi) > 0 {
+        r.hi = append([]byte{}, key...)
+    }
+}
+
+// whether any of the sorted keys is in the range
+func (r *keyRange) overlaps(keys [][]byte) bool {
+    i := sort.Search(len(keys), func(i int) bool {
+        return bytes.Compare(keys[i], r.lo) >= 0
+    })
+    return i < len(keys) && (r.inf || bytes.Compare(keys[i], r.hi) <= 0)
+}
+
+// begin a transaction
+func (db *KV) Begin() *KVTX {
+    tx := &KVTX{db: db, snap: db.BeginRead(), deleted: map[string]bool{}}
+    tx.pending = memTree()
+    tx.done = tx.snap.done // the KV is closed
+    return tx
+}
+
+// a tree in memory for the pending updates
+func memTree() BTree {
+    pages := map[uint64]BNode{}
+    next := uint64(1)
+    return BTree{
+        get: func(ptr uint64) BNode {
+            node, ok := pages[ptr]
+            assert(ok, "Page not found in get()")
+            return node
+        },
+        new: func(node BNode) uint64 {
+            ptr := next
+            next++
+            pages[ptr] = node
+            return ptr
+        },
+        del: func(ptr uint64) {
+            delete(pages, ptr)
+        },
+    }
+}
+
+// the oldest version that can still be read, the caller holds db.mu
+func oldestVersion(db *KV) uint64 {
+    oldest := db.snap.version
+    for version := range db.readers {
+        if version < oldest {
+            oldest = version
+        }
+    }
+    return oldest
+}
+
+// the number of pages on top of the free list that can still be seen by the
+// readers, the pages freed before the oldest reader's version are released
+// New readers only see the last commit, so the pages can't be held again.
+func heldCount(db *KV) int {
+    oldest := oldestVersion(db)
+    // the pages freed by the commit of version v are in the tree of v-1
+    for len(db.held) > 0 && db.held[0].version <= oldest {
+        db.held = db.held[1:]
+    }
+    n := 0
+    for _, h := range db.held {
+        n += h.n
+    }
+    return n
+}
+
+// the transaction is done, its snapshot is released
+func txEnd(tx *KVTX) {
+    tx.done = true
+    tx.snap.Close()
+}
+
+// the transaction can still be used
+func txCheck(tx *KVTX) error {
+    if tx.snap.stale() {
+        return ErrClosed
+    }
+    if tx.done {
+        return ErrTxDone
+    }
+    return nil
+}
+
+// end a transaction: commit updates
+// ErrConflict means nothing was written, the transaction can be retried.
+func (tx *KVTX) Commit() error {
+    if err := txCheck(tx); err != nil {
+        return err
+    }
+    defer txEnd(tx)
+    if tx.pending.root == 0 {
+        return nil // read-only or nothing changed
+    }
+    db := tx.db
+    db.writer.Lock()
+    defer db.writer.Unlock()
+    if tx.snap.stale() {
+        return ErrClosed // closed while waiting for the lock
+    }
+    if txConflict(tx) {
+        return ErrConflict
+    }
+    db.mu.Lock()
+    db.page.nhold = heldCount(db)
+    db.mu.Unlock()
+
+    keys, err := txApply(tx)
+    if err != nil {
+        revertPages(db)
+        return err
+    }
+    if len(db.page.updates) == 0 {
+        return nil // nothing changed
+    }
+    if err := flushPages(db); err != nil {
+        return err
+    }
+    // keep the keys for the transactions that are still running
+    tx.snap.Close()
+    db.mu.Lock()
+    db.history = append(db.history, commitKeys{db.snap.version, keys})
+    oldest := oldestVersion(db)
+    for len(db.history) > 0 && db.history[0].version <= oldest {
+        db.history = db.history[1:]
+    }
+    db.mu.Unlock()
+    return nil
+}
+
+// whether the reads of the transaction were updated by the commits after
+// its snapshot, the caller holds db.writer
+func txConflict(tx *KVTX) bool {
+    for _, c := range tx.db.history {
+        if c.version <= tx.snap.version {
+            continue
+        }
+        for _, r := range tx.reads {
+            if r.overlaps(c.keys) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// apply the pending updates to the latest tree, returns the updated keys
+// in order
+func txApply(tx *KVTX) ([][]byte, error) {
+    keys := [][]byte{}
+    tree := &tx.db.tree
+    for iter := tx.pending.Seek(nil, CMP_GT); iter.Valid(); iter.Next() {
+        key, val := iter.Deref()
+        var err error
+        if tx.deleted[string(key)] {
+            _, err = tree.Delete(key)
+        } else {
+            err = tree.Insert(key, val)
+        }
+        if err != nil {
+            return nil, err
+        }
+        keys = append(keys, key)
+    }
+    return keys, nil
+}
+
+// end a transaction: rollback
+func (tx *KVTX) Abort() {
+    if tx.done {
+        return
+    }
+    txEnd(tx)
+}
+
+// the updates made by the transaction are visible to itself
+// The value is valid until the transaction is done.
+func (tx *KVTX) Get(key []byte) (val []byte, ok bool, err error) {
+    if err := txCheck(tx); err != nil {
+        return nil, false, err
+    }
+    return txGet(tx, key)
+}
+
+// read the key from the pending updates or the snapshot, and record it
+func txGet(tx *KVTX, key []byte) ([]byte, bool, error) {
+    r := &keyRange{}
+    r.add(key)
+    tx.reads = append(tx.reads, r)
+    if val, ok := tx.pending.Get(key); ok {
+        return val, !tx.deleted[string(key)], nil
+    }
+    return tx.snap.tree.getChecked(key)
+}
+
+// the iterator sees the pending updates, but it's invalidated by the
+// updates made after the Seek()
+func (tx *KVTX) Seek(key []byte, cmp int) *KVIter {
+    if err := txCheck(tx); err != nil {
+        return &KVIter{err: err}
+    }
+    it := &KVIter{
+        snap: treeIter{tree: &tx.snap.tree},
+        pend: treeIter{tree: &tx.pending},
+        deleted: tx.deleted,
+        read: &keyRange{},
+        snapOf: tx.snap,
+    }
+    tx.reads = append(tx.reads, it.read)
+    return kvSeek(it, key, cmp)
+}
+
+func (tx *KVTX) Set(key []byte, val []byte) error {
+    return tx.InsertEx(&InsertReq{Key: key, Val: val, Mode: MODE_UPSERT})
+}
+
+// insert with a mode, see BTree.InsertEx()
+func (tx *KVTX) InsertEx(req *InsertReq) error {
+    if err := txCheck(tx); err != nil {
+        return err
+    }
+    if err := insertCheck(req); err != nil {
+        return err
+    }
+    old, exists, err := txGet(tx, req.Key)
+    if err != nil {
+        return err
+    }
+    if !insertDecide(req, old, exists) {
+        return nil
+    }
+    if err := tx.pending.Insert(req.Key, req.Val); err != nil {
+        return err
+    }
+    delete(tx.deleted, string(req.Key))
+    req.Added, req.Updated = !exists, true
+    return nil
+}
+
+// returns whether the key was added or changed
+func (tx *KVTX) Update(key []byte, val []byte, mode int) (bool, error) {
+    req := &InsertReq{Key: key, Val: val, Mode: mode}
+    err := tx.InsertEx(req)
+    return req.Updated, err
+}
+
+func (tx *KVTX) Del(key []byte) (bool, error) {
+    if err := txCheck(tx); err != nil {
+        return false, err
+    }
+    if err := checkKey(key); err != nil {
+        return false, err
+    }
+    _, exists, err := txGet(tx, key)
+    if err != nil || !exists {
+        return false, err
+    }
+    if err := tx.pending.Insert(key, nil); err != nil {
+        return false, err
+    }
+    tx.deleted[string(key)] = true
+    return true, nil
+}
+
+// read-only transaction
+// A reader reads the snapshot of the last commit when it began, the updates
+// committed after that are not visible to it. The copy-on-write tree leaves
+// the pages of the old versions intact, except that the freed pages can be
+// reused, so the pages freed after the reader's version are held back until
+// the reader is closed. Readers don't block the commits or each other.
+type KVReader struct {
+    db *KV
+    gen uint64 // the generation of the KV, see KV.gen
+    version uint64
+    tree BTree
+    done bool
+}
+
+// begin a read-only transaction
+// The reader must be closed, or the free pages can't be reused.
+func (db *KV) BeginRead() *KVReader {
+    r := &KVReader{db: db}
+    db.mu.Lock()
+    r.gen = db.gen.Load()
+    if r.gen == 0 {
+        db.mu.Unlock()
+        r.done = true // the KV is closed
+        return r
+    }
+    snap := db.snap
+    r.version = snap.version
+    db.readers[r.version]++
+    db.mu.Unlock()
+
+    flags := db.flags
+    r.tree.root = snap.root
+    r.tree.get = func(ptr uint64) BNode {
+        return pageRead(snap.chunks, snap.flushed, flags, ptr)
+    }
+    return r
+}
+
+// end a read-only transaction
+func (r *KVReader) Close() {
+    if r.done {
+        return
+    }
+    r.done = true
+    db := r.db
+    db.mu.Lock()
+    // a stale reader is not counted by the KV opened again
+    if !r.stale() {
+        if db.readers[r.version]--; db.readers[r.version] == 0 {
+            delete(db.readers, r.version)
+        }
+    }
+    db.mu.Unlock()
+}
+
+// the KV was closed after the reader began (or before)
+func (r *KVReader) stale() bool {
+    return r.gen == 0 || r.gen != r.db.gen.Load()
+}
+
+func readerCheck(r *KVReader) error {
+    if r.stale() {
+        return ErrClosed
+    }
+    if r.done {
+        return ErrTxDone
+    }
+    return nil
+}
+
+// the value is valid until the reader is closed
+func (r *KVReader) Get(key []byte) ([]byte, bool, error) {
+    if err := readerCheck(r); err != nil {
+        return nil, false, err
+    }
+    return r.tree.getChecked(key)
+}
+
+func (r *KVReader) Seek(key []byte, cmp int) *KVIter {
+    if err := readerCheck(r); err != nil {
+        return &KVIter{err: err}
+    }
+    return kvSeek(&KVIter{snap: treeIter{tree: &r.tree}, snapOf: r}, key, cmp)
+}
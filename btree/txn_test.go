@@ -0,0 +1,535 @@
+package btree
+
+import (
+    "fmt"
+    "os"
+    "math/rand"
+    "path/filepath"
+    "sort"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestKVTX(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    ref := map[string]string{}
+    for i := 0; i < 100; i++ {
+        key := fmt.Sprintf("key%d", i)
+        if err := db.Set([]byte(key), []byte(key)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = key
+    }
+    flushed := db.page.flushed
+
+    // the updates are visible to the transaction but not written
+    tx := db.Begin()
+    for i := 0; i < 100; i++ {
+        if err := tx.Set([]byte(fmt.Sprintf("new%d", i)), []byte("x")); err != nil {
+            t.Fatal(err)
+        }
+        if ok, err := tx.Del([]byte(fmt.Sprintf("key%d", i))); err != nil || !ok {
+            t.Fatalf("Del() = %v, %v", ok, err)
+        }
+    }
+    if val, ok, err := tx.Get([]byte("new5")); err != nil || !ok || string(val) != "x" {
+        t.Fatalf("Get() = %q, %v, %v", val, ok, err)
+    }
+    if _, ok, _ := tx.Get([]byte("key5")); ok {
+        t.Fatal("found a deleted key")
+    }
+    n := 0
+    for it := tx.Seek([]byte("new"), CMP_GE); it.Valid(); it.Next() {
+        n++
+    }
+    if n != 100 {
+        t.Fatalf("got %d keys", n)
+    }
+    if db.page.flushed != flushed {
+        t.Fatal("pages written before the commit")
+    }
+
+    // abort
+    tx.Abort()
+    kvVerify(t, db, ref)
+    if err := tx.Set([]byte("a"), []byte("b")); err != ErrTxDone {
+        t.Fatalf("got %v after abort", err)
+    }
+    if err := tx.Commit(); err != ErrTxDone {
+        t.Fatalf("got %v after abort", err)
+    }
+
+    // commit
+    tx = db.Begin()
+    for i := 0; i < 50; i++ {
+        key := fmt.Sprintf("key%d", i)
+        if err := tx.Set([]byte(key), []byte("y")); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = "y"
+    }
+    if ok, err := tx.Update([]byte("key99"), []byte("z"), MODE_INSERT_ONLY); err != nil || ok {
+        t.Fatalf("Update() = %v, %v", ok, err)
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := tx.Del([]byte("key0")); err != ErrTxDone {
+        t.Fatalf("got %v after commit", err)
+    }
+    kvVerify(t, db, ref)
+
+    // an empty transaction writes nothing
+    flushed = db.page.flushed
+    tx = db.Begin()
+    if err := tx.Commit(); err != nil || db.page.flushed != flushed {
+        t.Fatalf("empty commit: %v", err)
+    }
+    db.Close()
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+
+    // closing aborts the transaction
+    tx = db.Begin()
+    tx.Set([]byte("lost"), []byte("lost"))
+    db.Close()
+    if err := tx.Commit(); err != ErrClosed {
+        t.Fatalf("got %v after close", err)
+    }
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+    db.Close()
+}
+
+// the pending updates are applied in order when their tree is deeper than
+// two levels
+func TestKVTXLarge(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    ref := map[string]string{}
+    tx := db.Begin()
+    for i := 0; i < 1000; i++ {
+        key := fmt.Sprintf("key%04d", i)
+        val := key + string(make([]byte, 2000))
+        if err := tx.Set([]byte(key), []byte(val)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = val
+    }
+    if depth := treeDepth(&tx.pending); depth < 3 {
+        t.Fatalf("depth %d", depth)
+    }
+    done := make(chan error, 1)
+    go func() {
+        done <- tx.Commit()
+    }()
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(10 * time.Second):
+        t.Fatal("the commit doesn't return")
+    }
+    kvVerify(t, db, ref)
+    db.Close()
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+    db.Close()
+}
+
+// a failed commit leaves nothing behind
+func TestKVTXCommitError(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    ref := map[string]string{"a": "1"}
+    if err := db.Set([]byte("a"), []byte("1")); err != nil {
+        t.Fatal(err)
+    }
+    fp := db.fp
+    db.fp, _ = os.Open(path) // read-only
+    tx := db.Begin()
+    for i := 0; i < 20; i++ {
+        if err := tx.Set([]byte(fmt.Sprintf("k%d", i)), make([]byte, 1000)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := tx.Commit(); err == nil {
+        t.Fatal("commit to a read-only file succeeded")
+    }
+    kvVerify(t, db, ref)
+    db.fp.Close()
+    db.fp = fp
+    db.Close()
+    db = openKV(t, path)
+    kvVerify(t, db, ref)
+    db.Close()
+}
+
+// a commit fails if the keys it read were updated after its snapshot
+func TestKVTXConflict(t *testing.T) {
+    db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+    defer db.Close()
+    ref := map[string]string{}
+    for _, key := range []string{"a", "c", "e", "g"} {
+        if err := db.Set([]byte(key), []byte(key)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = key
+    }
+    // run fn in a transaction while another one commits the update
+    // A read-only transaction never conflicts, so the transaction updates z.
+    nconflict := 0
+    conflict := func(fn func(tx *KVTX), key string, del bool) error {
+        t.Helper()
+        tx := db.Begin()
+        fn(tx)
+        nconflict++
+        z := fmt.Sprint(nconflict)
+        if err := tx.Set([]byte("z"), []byte(z)); err != nil {
+            t.Fatal(err)
+        }
+        other := db.Begin()
+        if del {
+            if ok, err := other.Del([]byte(key)); err != nil || !ok {
+                t.Fatalf("Del() = %v, %v", ok, err)
+            }
+            delete(ref, key)
+        } else {
+            if err := other.Set([]byte(key), []byte(z)); err != nil {
+                t.Fatal(err)
+            }
+            ref[key] = z
+        }
+        if err := other.Commit(); err != nil {
+            t.Fatal(err)
+        }
+        err := tx.Commit()
+        if err == nil {
+            ref["z"] = z
+        }
+        kvVerify(t, db, ref)
+        return err
+    }
+    get := func(key string) func(tx *KVTX) {
+        return func(tx *KVTX) {
+            tx.Get([]byte(key))
+        }
+    }
+    // scan n keys from the key
+    scan := func(key string, cmp int, n int) func(tx *KVTX) {
+        return func(tx *KVTX) {
+            it := tx.Seek([]byte(key), cmp)
+            for i := 0; i < n && it.Valid(); i++ {
+                if cmp > 0 {
+                    it.Next()
+                } else {
+                    it.Prev()
+                }
+            }
+        }
+    }
+
+    cases := []struct {
+        fn func(tx *KVTX)
+        key string
+        del bool
+        want error
+    }{
+        {get("a"), "a", false, ErrConflict},
+        {get("a"), "c", false, nil},
+        {get("b"), "b", false, ErrConflict}, // a missing key
+        {get("c"), "c", true, ErrConflict},
+        {scan("b", CMP_GE, 1), "d", false, ErrConflict}, // b-e
+        {scan("b", CMP_GE, 1), "f", false, nil},
+        {scan("f", CMP_GT, 0), "fa", false, ErrConflict}, // f-g
+        {scan("e", CMP_LE, 1), "d", true, ErrConflict}, // d-e
+        {scan("e", CMP_LE, 1), "a", false, nil}, // b-e
+        {scan("x", CMP_GE, 0), "y", false, ErrConflict}, // past the end
+        {scan("0", CMP_LT, 0), "/", false, ErrConflict}, // before the start
+        {scan("h", CMP_GE, 0), "0", false, nil},
+    }
+    for i, c := range cases {
+        if err := conflict(c.fn, c.key, c.del); err != c.want {
+            t.Fatalf("case %d: got %v, want %v", i, err, c.want)
+        }
+    }
+
+    // a blind update still reads the key, see KVTX.InsertEx()
+    if err := conflict(func(*KVTX) {}, "z", false); err != ErrConflict {
+        t.Fatalf("got %v", err)
+    }
+    // the updates of the single operations are retried
+    tx := db.Begin()
+    tx.Get([]byte("a"))
+    if err := db.Set([]byte("a"), []byte("1")); err != nil {
+        t.Fatal(err)
+    }
+    tx.Abort()
+    if err := db.Set([]byte("a"), []byte("2")); err != nil {
+        t.Fatal(err)
+    }
+    if len(db.history) != 0 {
+        t.Fatalf("%d commits kept after the transactions", len(db.history))
+    }
+}
+
+// the transaction sees its own updates in the order of the keys
+func TestKVTXSeek(t *testing.T) {
+    db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+    defer db.Close()
+    r := rand.New(rand.NewSource(1))
+    ref := map[string]string{}
+    for i := 0; i < 200; i += 2 {
+        key := fmt.Sprintf("key%03d", i)
+        if err := db.Set([]byte(key), []byte(key)); err != nil {
+            t.Fatal(err)
+        }
+        ref[key] = key
+    }
+    tx := db.Begin()
+    defer tx.Abort()
+    for round := 0; round < 100; round++ {
+        // update or delete some keys
+        for i := 0; i < 10; i++ {
+            key := fmt.Sprintf("key%03d", r.Intn(200))
+            if r.Intn(3) == 0 {
+                if _, err := tx.Del([]byte(key)); err != nil {
+                    t.Fatal(err)
+                }
+                delete(ref, key)
+            } else {
+                val := fmt.Sprintf("%s-%d", key, round)
+                if err := tx.Set([]byte(key), []byte(val)); err != nil {
+                    t.Fatal(err)
+                }
+                ref[key] = val
+            }
+        }
+        keys := []string{}
+        for key := range ref {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+
+        // seek and move in both directions
+        cmp := []int{CMP_GE, CMP_GT, CMP_LT, CMP_LE}[r.Intn(4)]
+        start := fmt.Sprintf("key%03d", r.Intn(200))
+        pos := sort.SearchStrings(keys, start) // the first key >= start
+        switch {
+        case cmp == CMP_GT && pos < len(keys) && keys[pos] == start:
+            pos++
+        case cmp == CMP_LT:
+            pos--
+        case cmp == CMP_LE && (pos == len(keys) || keys[pos] != start):
+            pos--
+        }
+        it := tx.Seek([]byte(start), cmp)
+        for step := 0; step < 20; step++ {
+            valid := pos >= 0 && pos < len(keys)
+            if it.Valid() != valid {
+                t.Fatalf("round %d step %d: valid %v, want %v", round, step, it.Valid(), valid)
+            }
+            if valid {
+                key, val := it.Deref()
+                if string(key) != keys[pos] || string(val) != ref[keys[pos]] {
+                    t.Fatalf("round %d step %d: got %q=%q, want %q=%q",
+                        round, step, key, val, keys[pos], ref[keys[pos]])
+                }
+            }
+            if r.Intn(2) == 0 {
+                it.Next()
+                if pos < len(keys) {
+                    pos++
+                }
+            } else {
+                it.Prev()
+                if pos >= 0 {
+                    pos--
+                }
+            }
+        }
+        if it.Err() != nil {
+            t.Fatal(it.Err())
+        }
+    }
+}
+
+// every page is either reachable, in the free list or the master page
+func kvPageCheck(t *testing.T, db *KV) {
+    t.Helper()
+    npages, _, err := treeCheck(&db.tree)
+    if err != nil {
+        t.Fatal(err)
+    }
+    nlist := 0
+    for ptr := db.free.head; ptr != 0; ptr = flnNext(db.pageGet(ptr)) {
+        nlist++
+    }
+    if got := 1 + npages + db.free.Total() + nlist; got != int(db.page.flushed) {
+        t.Fatalf("%d pages accounted for, %d in use", got, db.page.flushed)
+    }
+}
+
+func TestKVReader(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openKV(t, path)
+    set := func(round int) {
+        t.Helper()
+        tx := db.Begin()
+        for i := 0; i < 200; i++ {
+            key := fmt.Sprintf("key%03d", i)
+            if err := tx.Set([]byte(key), []byte(fmt.Sprintf("%s-%d", key, round))); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if err := tx.Commit(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // the reader sees the round
+    check := func(r *KVReader, round int) {
+        t.Helper()
+        n := 0
+        it := r.Seek(nil, CMP_GE)
+        for ; it.Valid(); it.Next() {
+            key, val := it.Deref()
+            if want := fmt.Sprintf("%s-%d", key, round); string(val) != want {
+                t.Fatalf("got %q, want %q", val, want)
+            }
+            n++
+        }
+        if it.Err() != nil || n != 200 {
+            t.Fatalf("got %d keys, %v", n, it.Err())
+        }
+    }
+
+    set(0)
+    r0 := db.BeginRead()
+    var r5 *KVReader
+    for round := 1; round < 20; round++ {
+        set(round)
+        if round == 5 {
+            r5 = db.BeginRead()
+        }
+        // the updates can't reuse the pages of the readers
+        check(r0, 0)
+        if r5 != nil {
+            check(r5, 5)
+        }
+    }
+    kvPageCheck(t, db)
+    grown := db.page.flushed
+    r0.Close()
+    r5.Close()
+
+    // the pages are reused once the readers are gone
+    r := db.BeginRead()
+    check(r, 19)
+    r.Close()
+    for round := 20; round < 40; round++ {
+        set(round)
+    }
+    kvPageCheck(t, db)
+    if db.page.flushed > grown + 20 {
+        t.Fatalf("database grew from %d to %d pages", grown, db.page.flushed)
+    }
+
+    // an uncommitted update is not visible
+    tx := db.Begin()
+    tx.Set([]byte("key000"), []byte("x"))
+    r = db.BeginRead()
+    check(r, 39)
+    tx.Abort()
+    r.Close()
+    if _, _, err := r.Get([]byte("key000")); err != ErrTxDone {
+        t.Fatalf("got %v on a closed reader", err)
+    }
+    db.Close()
+
+    // the held pages are free after a restart
+    db = openKV(t, path)
+    kvPageCheck(t, db)
+    db.Close()
+}
+
+func TestKVConcurrent(t *testing.T) {
+    db := openKV(t, filepath.Join(t.TempDir(), "test.db"))
+    defer db.Close()
+    const nkeys = 50
+    errs := make(chan error, 8)
+    done := make(chan struct{})
+
+    // the writers update all the keys to the same value in a transaction,
+    // and retry on conflicts
+    var wg sync.WaitGroup
+    for w := 0; w < 2; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for round := 0; round < 50; {
+                tx := db.Begin()
+                for i := 0; i < nkeys; i++ {
+                    val := fmt.Sprintf("%d-%d", w, round)
+                    if err := tx.Set([]byte(fmt.Sprintf("key%d", i)), []byte(val)); err != nil {
+                        tx.Abort()
+                        errs <- err
+                        return
+                    }
+                }
+                err := tx.Commit()
+                if err == ErrConflict {
+                    continue
+                }
+                if err != nil {
+                    errs <- err
+                    return
+                }
+                round++
+            }
+        }(w)
+    }
+    // so the readers always see the same value for all the keys
+    var rg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        rg.Add(1)
+        go func() {
+            defer rg.Done()
+            for {
+                select {
+                case <-done:
+                    return
+                default:
+                }
+                r := db.BeginRead()
+                first, n := "", 0
+                for it := r.Seek(nil, CMP_GE); it.Valid(); it.Next() {
+                    _, val := it.Deref()
+                    if n == 0 {
+                        first = string(val)
+                    } else if string(val) != first {
+                        errs <- fmt.Errorf("inconsistent snapshot: %q and %q", first, val)
+                        r.Close()
+                        return
+                    }
+                    n++
+                }
+                r.Close()
+                if n != 0 && n != nkeys {
+                    errs <- fmt.Errorf("got %d keys", n)
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    close(done)
+    rg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Fatal(err)
+    }
+    kvPageCheck(t, db)
+}
@@ -1,13 +1,19 @@
 package cmd 
 
 import(
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "sync"
+
     "github.com/IAmRiteshKoushik/db-dev/btree"
 )
 
 const(
     TYPE_ERROR = 0
     TYPE_BYTES = 1
-    TPE_INT64 = 2
+    TYPE_INT64 = 2
 )
 
 // table cell
@@ -23,18 +29,61 @@ type Record struct{
     Vals []Value
 }
 
-func (rec *Record) AddStr(key string, val []byte) *Record
-func (rec *Record) AddInt64(key string, val int64) *Record
-func (rec *Record) Get(key string) *Value
+func (rec *Record) AddStr(key string, val []byte) *Record {
+    rec.Cols = append(rec.Cols, key)
+    rec.Vals = append(rec.Vals, Value{Type: TYPE_BYTES, Str: val})
+    return rec
+}
+
+func (rec *Record) AddInt64(key string, val int64) *Record {
+    rec.Cols = append(rec.Cols, key)
+    rec.Vals = append(rec.Vals, Value{Type: TYPE_INT64, I64: val})
+    return rec
+}
+
+// returns nil for a missing column
+func (rec *Record) Get(key string) *Value {
+    for i, col := range rec.Cols {
+        if col == key {
+            return &rec.Vals[i]
+        }
+    }
+    return nil
+}
+
+// the type name used in the error messages
+func typeName(typ uint32) string {
+    switch typ {
+    case TYPE_BYTES:
+        return "BYTES"
+    case TYPE_INT64:
+        return "INT64"
+    default:
+        return fmt.Sprintf("type(%d)", typ)
+    }
+}
 
 type DB struct {
     Path string
     // internals
-    // TODO: To be fixed later
-    // kv KV 
+    kv btree.KV
+    mu sync.Mutex // protects the cache
     tables map[string]*TableDef // cached table definition
 }
 
+func (db *DB) Open() error {
+    db.kv.Path = db.Path
+    db.tables = map[string]*TableDef{}
+    if err := db.kv.Open(); err != nil {
+        return fmt.Errorf("DB.Open: %w", err)
+    }
+    return nil
+}
+
+func (db *DB) Close() error {
+    return db.kv.Close()
+}
+
 type TableDef struct {
     // user defined
     Name    string
@@ -45,6 +94,11 @@ type TableDef struct {
     // To support multiple tables, the keys in KV store are prefixed with 
     // unique 32-bit number
     Prefix  uint32
+    // secondary indexes, the columns of each index
+    // The primary key columns are appended to each index on creation, so
+    // that the index keys are unique and lead back to the row.
+    Indexes [][]string
+    IndexPrefixes []uint32 // auto-assigned, one for each index
 }
 
 // For storing table definitions (which is metadata)
@@ -65,3 +119,260 @@ var TDEF_TABLE = &TableDef{
     Cols:   []string{"name", "def"},
     PKeys:  1,
 }
+
+var INTERNAL_TABLES = map[string]*TableDef{
+    TDEF_META.Name:  TDEF_META,
+    TDEF_TABLE.Name: TDEF_TABLE,
+}
+
+// the prefixes below are reserved for the internal tables
+const TABLE_PREFIX_MIN = 100
+
+// the key in @meta that holds the next table prefix
+const META_NEXT_PREFIX = "next_prefix"
+
+// get the table definition by name
+// The definitions are read from @table on the first use and then cached, so
+// a table created before a restart is found again. A nil definition means
+// the table doesn't exist.
+func getTableDef(tx *DBTX, name string) (*TableDef, error) {
+    if tdef, ok := INTERNAL_TABLES[name]; ok {
+        return tdef, nil
+    }
+    db := tx.db
+    db.mu.Lock()
+    tdef := db.tables[name]
+    db.mu.Unlock()
+    if tdef == nil {
+        tdef = tx.tables[name]
+    }
+    if tdef != nil {
+        return tdef, nil
+    }
+    tdef, err := getTableDefDB(tx, name)
+    if err != nil || tdef == nil {
+        return nil, err
+    }
+    if tx.tables != nil {
+        tx.tables[name] = tdef // cached by the commit, see DBTX
+        return tdef, nil
+    }
+    db.mu.Lock()
+    db.tables[name] = tdef
+    db.mu.Unlock()
+    return tdef, nil
+}
+
+// load the table definition from @table
+func getTableDefDB(tx *DBTX, name string) (*TableDef, error) {
+    rec := (&Record{}).AddStr("name", []byte(name))
+    ok, err := dbGet(tx, TDEF_TABLE, rec)
+    if err != nil || !ok {
+        return nil, err
+    }
+    tdef := &TableDef{}
+    if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+        return nil, fmt.Errorf("table %s: bad definition: %w", name, err)
+    }
+    return tdef, nil
+}
+
+// the table definition, or an error for a missing table
+func tableDefOf(tx *DBTX, name string) (*TableDef, error) {
+    tdef, err := getTableDef(tx, name)
+    if err != nil {
+        return nil, err
+    }
+    if tdef == nil {
+        return nil, fmt.Errorf("table not found: %s", name)
+    }
+    return tdef, nil
+}
+
+// get the table definition, the result must not be modified
+func (tx *DBTX) TableDef(name string) (*TableDef, error) {
+    return tableDefOf(tx, name)
+}
+
+// the table definition for an update or a delete
+// The internal tables are read-only, they are only updated by tableNew,
+// otherwise the table definitions and the prefix counter could be broken.
+func tableDefWrite(tx *DBTX, name string) (*TableDef, error) {
+    if _, ok := INTERNAL_TABLES[name]; ok {
+        return nil, fmt.Errorf("table is read-only: %s", name)
+    }
+    return tableDefOf(tx, name)
+}
+
+// the same as TableDef, but fails for the read-only tables
+func (tx *DBTX) TableDefWrite(name string) (*TableDef, error) {
+    return tableDefWrite(tx, name)
+}
+
+// create a new table
+// The table is assigned the next free prefixes from @meta, and the
+// definition is stored as JSON in @table. tdef.Prefix and the indexes are
+// set on success.
+func (tx *DBTX) TableNew(tdef *TableDef) error {
+    if _, err := txWriter(tx); err != nil {
+        return err
+    }
+    return tableNew(tx, tdef)
+}
+
+// the same as above, in a transaction
+func (db *DB) TableNew(tdef *TableDef) error {
+    return dbWrite(db, func(tx *DBTX) error {
+        return tx.TableNew(tdef)
+    })
+}
+
+func tableNew(tx *DBTX, tdef *TableDef) error {
+    if err := tableDefCheck(tdef); err != nil {
+        return err
+    }
+    indexes, err := indexDefCheck(tdef)
+    if err != nil {
+        return err
+    }
+    // check the existing table
+    if old, err := getTableDef(tx, tdef.Name); err != nil {
+        return err
+    } else if old != nil {
+        return fmt.Errorf("table exists: %s", tdef.Name)
+    }
+
+    // allocate the new prefixes, one for the table and one for each index
+    prefix := uint32(TABLE_PREFIX_MIN)
+    meta := (&Record{}).AddStr("key", []byte(META_NEXT_PREFIX))
+    ok, err := dbGet(tx, TDEF_META, meta)
+    if err != nil {
+        return err
+    }
+    if ok {
+        val := meta.Get("val").Str
+        if len(val) != 4 {
+            return fmt.Errorf("@meta: bad %s", META_NEXT_PREFIX)
+        }
+        prefix = binary.LittleEndian.Uint32(val)
+        if prefix < TABLE_PREFIX_MIN {
+            return fmt.Errorf("@meta: bad %s: %d", META_NEXT_PREFIX, prefix)
+        }
+    }
+    next := make([]byte, 4)
+    binary.LittleEndian.PutUint32(next, prefix + 1 + uint32(len(indexes)))
+    meta = (&Record{}).AddStr("key", []byte(META_NEXT_PREFIX)).AddStr("val", next)
+    _, err = dbUpdate(tx, TDEF_META, *meta, MODE_UPSERT)
+    if err != nil {
+        return err
+    }
+
+    // store the definition
+    def := *tdef
+    def.Prefix = prefix
+    def.Indexes = indexes
+    def.IndexPrefixes = nil
+    for i := range indexes {
+        def.IndexPrefixes = append(def.IndexPrefixes, prefix + 1 + uint32(i))
+    }
+    data, err := json.Marshal(&def)
+    if err != nil {
+        return err
+    }
+    rec := (&Record{}).AddStr("name", []byte(def.Name)).AddStr("def", data)
+    _, err = dbUpdate(tx, TDEF_TABLE, *rec, MODE_INSERT_ONLY)
+    if err != nil {
+        return err
+    }
+    tdef.Prefix = def.Prefix
+    tdef.Indexes = def.Indexes
+    tdef.IndexPrefixes = def.IndexPrefixes
+    return nil
+}
+
+// validate a table definition given by the user
+func tableDefCheck(tdef *TableDef) error {
+    if tdef.Name == "" {
+        return fmt.Errorf("table name is empty")
+    }
+    if strings.HasPrefix(tdef.Name, "@") {
+        return fmt.Errorf("table name is reserved: %s", tdef.Name)
+    }
+    if len(tdef.Cols) == 0 {
+        return fmt.Errorf("table %s: no columns", tdef.Name)
+    }
+    if len(tdef.Cols) != len(tdef.Types) {
+        return fmt.Errorf("table %s: %d columns and %d types",
+            tdef.Name, len(tdef.Cols), len(tdef.Types))
+    }
+    if tdef.PKeys < 1 || tdef.PKeys > len(tdef.Cols) {
+        return fmt.Errorf("table %s: bad number of primary key columns: %d",
+            tdef.Name, tdef.PKeys)
+    }
+    seen := map[string]bool{}
+    for i, col := range tdef.Cols {
+        if col == "" {
+            return fmt.Errorf("table %s: empty column name", tdef.Name)
+        }
+        if seen[col] {
+            return fmt.Errorf("table %s: duplicate column %s", tdef.Name, col)
+        }
+        seen[col] = true
+        switch tdef.Types[i] {
+        case TYPE_BYTES, TYPE_INT64:
+        default:
+            return fmt.Errorf("table %s: bad type for column %s", tdef.Name, col)
+        }
+    }
+    return nil
+}
+
+// check the record against the table definition
+// The columns of the record can be in any order. n is the number of required
+// columns, either all the columns (for an update) or only the primary key
+// (for a lookup or a delete). The values are returned in the order of the
+// table columns.
+func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
+    if n != tdef.PKeys && n != len(tdef.Cols) {
+        panic("checkRecord: bad number of columns")
+    }
+    if len(rec.Cols) != len(rec.Vals) {
+        return nil, fmt.Errorf("record has %d columns and %d values",
+            len(rec.Cols), len(rec.Vals))
+    }
+    vals := make([]Value, n)
+    for i, col := range rec.Cols {
+        idx := colIndex(tdef, col)
+        if idx < 0 {
+            return nil, fmt.Errorf("table %s: unknown column %s", tdef.Name, col)
+        }
+        if idx >= n {
+            return nil, fmt.Errorf("table %s: expected the primary key only, got column %s",
+                tdef.Name, col)
+        }
+        if vals[idx].Type != TYPE_ERROR {
+            return nil, fmt.Errorf("table %s: duplicate column %s", tdef.Name, col)
+        }
+        if rec.Vals[i].Type != tdef.Types[idx] {
+            return nil, fmt.Errorf("table %s: column %s: expected %s, got %s",
+                tdef.Name, col, typeName(tdef.Types[idx]), typeName(rec.Vals[i].Type))
+        }
+        vals[idx] = rec.Vals[i]
+    }
+    for i := 0; i < n; i++ {
+        if vals[i].Type == TYPE_ERROR {
+            return nil, fmt.Errorf("table %s: missing column %s", tdef.Name, tdef.Cols[i])
+        }
+    }
+    return vals, nil
+}
+
+// the position of the column in the table, -1 if it doesn't exist
+func colIndex(tdef *TableDef, col string) int {
+    for i, c := range tdef.Cols {
+        if c == col {
+            return i
+        }
+    }
+    return -1
+}
@@ -0,0 +1,250 @@
+package cmd
+
+import (
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func openDB(t *testing.T, path string) *DB {
+    t.Helper()
+    db := &DB{Path: path}
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+func bytesValue(s string) Value {
+    return Value{Type: TYPE_BYTES, Str: []byte(s)}
+}
+
+// the table definition in a read-only transaction
+func getTdef(db *DB, name string) (*TableDef, error) {
+    tx := db.BeginRead()
+    defer tx.Abort()
+    return tableDefOf(tx, name)
+}
+
+func int64Val(i int64) Value {
+    return Value{Type: TYPE_INT64, I64: i}
+}
+
+func usersDef() *TableDef {
+    return &TableDef{
+        Name:  "users",
+        Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES},
+        Cols:  []string{"id", "name", "email"},
+        PKeys: 1,
+    }
+}
+
+func createTable(t *testing.T, db *DB, tdef *TableDef) {
+    t.Helper()
+    if err := db.TableNew(tdef); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func userRec(id int64, name, email string) Record {
+    return Record{
+        Cols: []string{"id", "name", "email"},
+        Vals: []Value{int64Val(id), bytesValue(name), bytesValue(email)},
+    }
+}
+
+func TestTableUpdates(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openDB(t, path)
+    tdef := usersDef()
+    createTable(t, db, tdef)
+
+    check := func(ok bool, err error, want bool) {
+        t.Helper()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ok != want {
+            t.Fatalf("got %v, want %v", ok, want)
+        }
+    }
+    ok, err := db.Insert("users", userRec(1, "alice", "a@x"))
+    check(ok, err, true)
+    ok, err = db.Insert("users", userRec(1, "bob", "b@x"))
+    check(ok, err, false)
+    ok, err = db.Update("users", userRec(2, "bob", "b@x"))
+    check(ok, err, false)
+    ok, err = db.Upsert("users", userRec(2, "bob", "b@x"))
+    check(ok, err, true)
+    ok, err = db.Update("users", userRec(1, "alice", "alice@x"))
+    check(ok, err, true)
+
+    key := encodeKey(nil, tdef.Prefix, []Value{int64Val(1)})
+    val, ok, err := db.kv.Get(key)
+    check(ok, err, true)
+    vals, err := decodeValues(val, 2)
+    if err != nil || string(vals[0].Str) != "alice" || string(vals[1].Str) != "alice@x" {
+        t.Fatalf("bad row %v, %v", vals, err)
+    }
+
+    pk := Record{Cols: []string{"id"}, Vals: []Value{int64Val(2)}}
+    ok, err = db.Delete("users", pk)
+    check(ok, err, true)
+    ok, err = db.Delete("users", pk)
+    check(ok, err, false)
+
+    // bad records
+    if _, err := db.Insert("nope", userRec(3, "c", "c@x")); err == nil {
+        t.Fatal("insert into a missing table")
+    }
+    if _, err := db.Insert("users", pk); err == nil {
+        t.Fatal("insert of a partial row")
+    }
+    bad := userRec(3, "c", "c@x")
+    bad.Vals[0] = bytesValue("3")
+    if _, err := db.Insert("users", bad); err == nil {
+        t.Fatal("insert of a bad type")
+    }
+    db.Close()
+
+    // the rows are in the file
+    db = openDB(t, path)
+    defer db.Close()
+    _, ok, err = db.kv.Get(key)
+    check(ok, err, true)
+}
+
+func TestTableNew(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openDB(t, path)
+
+    users := usersDef()
+    createTable(t, db, users)
+    if users.Prefix != TABLE_PREFIX_MIN {
+        t.Fatalf("bad prefix %d", users.Prefix)
+    }
+    if err := db.TableNew(usersDef()); err == nil {
+        t.Fatal("created a table twice")
+    }
+    items := &TableDef{
+        Name:  "items",
+        Types: []uint32{TYPE_BYTES, TYPE_INT64, TYPE_INT64},
+        Cols:  []string{"owner", "id", "count"},
+        PKeys: 2,
+    }
+    createTable(t, db, items)
+    if items.Prefix != TABLE_PREFIX_MIN + 1 {
+        t.Fatalf("bad prefix %d", items.Prefix)
+    }
+
+    // bad definitions
+    bad := []func(*TableDef){
+        func(d *TableDef) { d.Name = "" },
+        func(d *TableDef) { d.Name = "@users" },
+        func(d *TableDef) { d.Cols, d.Types = nil, nil },
+        func(d *TableDef) { d.Types = d.Types[:2] },
+        func(d *TableDef) { d.PKeys = 0 },
+        func(d *TableDef) { d.PKeys = 4 },
+        func(d *TableDef) { d.Cols[2] = "id" },
+        func(d *TableDef) { d.Cols[1] = "" },
+        func(d *TableDef) { d.Types[1] = TYPE_ERROR },
+    }
+    for i, f := range bad {
+        tdef := usersDef()
+        tdef.Name = "bad"
+        f(tdef)
+        if err := db.TableNew(tdef); err == nil {
+            t.Fatalf("bad definition %d accepted", i)
+        }
+    }
+    // the internal tables are read-only
+    badDef := Record{
+        Cols: []string{"name", "def"},
+        Vals: []Value{bytesValue("bad"), bytesValue("{")},
+    }
+    if _, err := db.Insert("@table", badDef); err == nil {
+        t.Fatal("inserted into @table")
+    }
+    if _, err := db.Delete("@meta", *(&Record{}).AddStr("key", []byte(META_NEXT_PREFIX))); err == nil {
+        t.Fatal("deleted from @meta")
+    }
+    err := dbWrite(db, func(tx *DBTX) error {
+        _, err := dbUpdate(tx, TDEF_TABLE, badDef, MODE_INSERT_ONLY)
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+
+    // the definitions are loaded from the file
+    db = openDB(t, path)
+    defer db.Close()
+    for _, want := range []*TableDef{users, items} {
+        got, err := getTdef(db, want.Name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !reflect.DeepEqual(got, want) {
+            t.Fatalf("got %+v, want %+v", got, want)
+        }
+    }
+    if _, err := getTdef(db, "nope"); err == nil {
+        t.Fatal("found a missing table")
+    }
+    if _, err := getTdef(db, "bad"); err == nil {
+        t.Fatal("loaded a bad definition")
+    }
+    // the prefix counter survives the restart
+    orders := usersDef()
+    orders.Name = "orders"
+    createTable(t, db, orders)
+    if orders.Prefix != TABLE_PREFIX_MIN + 2 {
+        t.Fatalf("bad prefix %d", orders.Prefix)
+    }
+}
+
+func TestRecord(t *testing.T) {
+    rec := (&Record{}).AddStr("name", []byte("alice")).AddInt64("id", 1)
+    if v := rec.Get("id"); v == nil || v.Type != TYPE_INT64 || v.I64 != 1 {
+        t.Fatalf("bad id %v", v)
+    }
+    if v := rec.Get("name"); v == nil || v.Type != TYPE_BYTES || string(v.Str) != "alice" {
+        t.Fatalf("bad name %v", v)
+    }
+    if rec.Get("email") != nil {
+        t.Fatal("got a missing column")
+    }
+
+    tdef := usersDef()
+    // the primary key in any order
+    vals, err := checkRecord(tdef, *rec.AddStr("email", []byte("a@x")), 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if vals[0].I64 != 1 || string(vals[1].Str) != "alice" || string(vals[2].Str) != "a@x" {
+        t.Fatalf("bad order %v", vals)
+    }
+    vals, err = checkRecord(tdef, *(&Record{}).AddInt64("id", 2), 1)
+    if err != nil || len(vals) != 1 || vals[0].I64 != 2 {
+        t.Fatalf("bad primary key %v %v", vals, err)
+    }
+
+    bad := []struct {
+        rec *Record
+        n   int
+    }{
+        {(&Record{}).AddInt64("id", 1).AddStr("name", nil), 3},          // missing
+        {(&Record{}).AddInt64("id", 1).AddStr("name", nil), 1},          // not a primary key
+        {(&Record{}).AddStr("id", nil), 1},                              // type
+        {(&Record{}).AddInt64("id", 1).AddInt64("id", 2), 1},            // duplicate
+        {(&Record{}).AddInt64("id", 1).AddStr("nope", nil), 1},          // unknown
+        {&Record{Cols: []string{"id"}}, 1},                              // no value
+        {(&Record{}).AddInt64("id", 1).AddStr("x", nil).AddStr("y", nil), 3},
+    }
+    for i, c := range bad {
+        if _, err := checkRecord(tdef, *c.rec, c.n); err == nil {
+            t.Fatalf("bad record %d accepted", i)
+        }
+    }
+}
@@ -1,10 +1,51 @@
 package cmd
 
 // deleting a record by its primary key
-func dbDelete(db *DB, tdef *TableDef, rec Record) (bool, error) {
+func dbDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
+    kvtx, err := txWriter(tx)
+    if err != nil {
+        return false, err
+    }
+    vals, err := checkRecord(tdef, rec, tdef.PKeys)
+    if err != nil {
+        return false, err
+    }
+    key := encodeKey(nil, tdef.Prefix, vals[:tdef.PKeys])
+    if len(tdef.Indexes) == 0 {
+        return kvtx.Del(key)
+    }
 
+    // the old row is needed to find its index entries
+    val, ok, err := tx.kv.Get(key)
+    if err != nil || !ok {
+        return false, err
+    }
+    rest, err := decodeRow(tdef, val)
+    if err != nil {
+        return false, err
+    }
+    if _, err := kvtx.Del(key); err != nil {
+        return false, err
+    }
+    old := append(vals[:tdef.PKeys:tdef.PKeys], rest...)
+    if err := indexOp(tx, tdef, old, INDEX_DEL); err != nil {
+        return false, err
+    }
+    return true, nil
 }
 
-func (db *DB) Delete(table string, rec Record) (bool, error) {
+func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+    tdef, err := tableDefWrite(tx, table)
+    if err != nil {
+        return false, err
+    }
+    return dbDelete(tx, tdef, rec)
+}
 
+func (db *DB) Delete(table string, rec Record) (deleted bool, err error) {
+    err = dbWrite(db, func(tx *DBTX) error {
+        deleted, err = tx.Delete(table, rec)
+        return err
+    })
+    return deleted, err
 }
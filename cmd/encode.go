@@ -0,0 +1,114 @@
+package cmd
+
+import(
+    "encoding/binary"
+    "fmt"
+)
+
+// Serializing the table cells
+// | type | data |
+// |  1B  |  ... |
+// The encoded keys are compared with bytes.Compare() by the B-tree, so the
+// encoding preserves the order of the values:
+// int64: 8B big-endian with the sign bit flipped, so that the negative
+//        numbers come before the positive ones
+// bytes: null-terminated, the 0x00 and 0x01 inside the string are escaped
+//        as 0x01 0x01 and 0x01 0x02, so that a prefix of a string still
+//        sorts before the string
+// The type byte is the same for all the values of a column, so it doesn't
+// affect the order.
+
+// the key of a row: | prefix 4B | the primary key columns |
+func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
+    var buf [4]byte
+    binary.BigEndian.PutUint32(buf[:], prefix)
+    out = append(out, buf[:]...)
+    return encodeValues(out, vals)
+}
+
+func encodeValues(out []byte, vals []Value) []byte {
+    for _, v := range vals {
+        out = append(out, byte(v.Type))
+        switch v.Type {
+        case TYPE_INT64:
+            var buf [8]byte
+            u := uint64(v.I64) + (1 << 63) // flip the sign bit
+            binary.BigEndian.PutUint64(buf[:], u)
+            out = append(out, buf[:]...)
+        case TYPE_BYTES:
+            out = escapeString(out, v.Str)
+            out = append(out, 0) // null-terminated
+        default:
+            panic("bad value type")
+        }
+    }
+    return out
+}
+
+// 0x00 => 0x01 0x01, 0x01 => 0x01 0x02
+func escapeString(out []byte, in []byte) []byte {
+    for _, ch := range in {
+        if ch <= 1 {
+            out = append(out, 0x01, ch + 1)
+        } else {
+            out = append(out, ch)
+        }
+    }
+    return out
+}
+
+// the reverse of escapeString(), up to the null terminator
+// returns the string and the remaining input
+func unescapeString(in []byte) ([]byte, []byte, error) {
+    out := []byte{}
+    for i := 0; i < len(in); i++ {
+        switch in[i] {
+        case 0:
+            return out, in[i + 1:], nil
+        case 1:
+            if i + 1 >= len(in) || in[i + 1] < 1 || in[i + 1] > 2 {
+                return nil, nil, fmt.Errorf("decode: bad escape")
+            }
+            i++
+            out = append(out, in[i] - 1)
+        default:
+            out = append(out, in[i])
+        }
+    }
+    return nil, nil, fmt.Errorf("decode: unterminated bytes")
+}
+
+// decode n values
+func decodeValues(in []byte, n int) ([]Value, error) {
+    vals := make([]Value, 0, n)
+    for i := 0; i < n; i++ {
+        if len(in) < 1 {
+            return nil, fmt.Errorf("decode: missing value %d", i)
+        }
+        v := Value{Type: uint32(in[0])}
+        in = in[1:]
+        switch v.Type {
+        case TYPE_INT64:
+            if len(in) < 8 {
+                return nil, fmt.Errorf("decode: short int64")
+            }
+            u := binary.BigEndian.Uint64(in)
+            v.I64 = int64(u - (1 << 63))
+            in = in[8:]
+        case TYPE_BYTES:
+            str, rest, err := unescapeString(in)
+            if err != nil {
+                return nil, err
+            }
+            v.Str = str
+            in = rest
+        default:
+            return nil, fmt.Errorf("decode: bad value type %d", v.Type)
+        }
+        vals = append(vals, v)
+    }
+    if len(in) != 0 {
+        return nil, fmt.Errorf("decode: %d trailing bytes", len(in))
+    }
+    return vals, nil
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+    "bytes"
+    "math"
+    "reflect"
+    "sort"
+    "testing"
+)
+
+func TestEncodeOrder(t *testing.T) {
+    ints := []int64{math.MinInt64, -1 << 40, -256, -1, 0, 1, 255, 256, 1 << 40, math.MaxInt64}
+    strs := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x01", "\x01\x00", "\x02", "a", "a\x00", "a\x00b", "ab", "b"}
+
+    check := func(vals []Value, less func(a, b Value) bool) {
+        t.Helper()
+        for i := range vals {
+            for j := range vals {
+                ki := encodeValues(nil, []Value{vals[i]})
+                kj := encodeValues(nil, []Value{vals[j]})
+                if (bytes.Compare(ki, kj) < 0) != less(vals[i], vals[j]) {
+                    t.Fatalf("bad order: %v %v", vals[i], vals[j])
+                }
+                got, err := decodeValues(ki, 1)
+                if err != nil || !reflect.DeepEqual(got[0], vals[i]) {
+                    t.Fatalf("bad decode: %v %v %v", vals[i], got, err)
+                }
+            }
+        }
+    }
+
+    ivals := []Value{}
+    for _, i := range ints {
+        ivals = append(ivals, int64Val(i))
+    }
+    check(ivals, func(a, b Value) bool { return a.I64 < b.I64 })
+
+    svals := []Value{}
+    for _, s := range strs {
+        svals = append(svals, bytesValue(s))
+    }
+    check(svals, func(a, b Value) bool { return bytes.Compare(a.Str, b.Str) < 0 })
+
+    // multi-column keys sort by the first column, then the second
+    type pair struct {
+        s string
+        i int64
+    }
+    pairs := []pair{}
+    for _, s := range strs {
+        for _, i := range ints {
+            pairs = append(pairs, pair{s, i})
+        }
+    }
+    keys := [][]byte{}
+    for _, p := range pairs {
+        keys = append(keys, encodeKey(nil, 100, []Value{bytesValue(p.s), int64Val(p.i)}))
+    }
+    sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+    sort.Slice(pairs, func(i, j int) bool {
+        if pairs[i].s != pairs[j].s {
+            return pairs[i].s < pairs[j].s
+        }
+        return pairs[i].i < pairs[j].i
+    })
+    for i, p := range pairs {
+        vals, err := decodeValues(keys[i][4:], 2)
+        if err != nil || string(vals[0].Str) != p.s || vals[1].I64 != p.i {
+            t.Fatalf("bad key order at %d: %v %v", i, vals, err)
+        }
+    }
+}
+
+func TestDecodeErrors(t *testing.T) {
+    bad := [][]byte{
+        {},
+        {TYPE_INT64, 1, 2},
+        {TYPE_BYTES, 'a'},
+        {TYPE_BYTES, 0x01, 0x03, 0},
+        {TYPE_BYTES, 0x01},
+        {TYPE_BYTES, 'a', 0, 'x'},
+        {9, 0},
+    }
+    for _, in := range bad {
+        if _, err := decodeValues(in, 1); err == nil {
+            t.Fatalf("decoded %q", in)
+        }
+    }
+}
@@ -1 +1,82 @@
 package cmd
+
+import "fmt"
+
+// Secondary indexes
+// Each index is stored as KV pairs with its own prefix:
+// key: | prefix | the index columns | the primary key columns |
+// val: empty
+// The primary key makes the index keys unique even if the indexed values are
+// not, and it's used to find the row from an index key.
+
+// check the indexes of a new table, the index columns are returned with the
+// missing primary key columns appended
+func indexDefCheck(tdef *TableDef) ([][]string, error) {
+    indexes := [][]string{}
+    for i, index := range tdef.Indexes {
+        if len(index) == 0 {
+            return nil, fmt.Errorf("table %s: index %d has no columns", tdef.Name, i)
+        }
+        seen := map[string]bool{}
+        for _, col := range index {
+            if colIndex(tdef, col) < 0 {
+                return nil, fmt.Errorf("table %s: index %d: unknown column %s",
+                    tdef.Name, i, col)
+            }
+            if seen[col] {
+                return nil, fmt.Errorf("table %s: index %d: duplicate column %s",
+                    tdef.Name, i, col)
+            }
+            seen[col] = true
+        }
+        index = append([]string{}, index...)
+        for _, col := range tdef.Cols[:tdef.PKeys] {
+            if !seen[col] {
+                index = append(index, col)
+            }
+        }
+        indexes = append(indexes, index)
+    }
+    if len(indexes) == 0 {
+        return nil, nil
+    }
+    return indexes, nil
+}
+
+// the key of an index entry from a row in the order of the table columns
+func encodeIndexKey(tdef *TableDef, idx int, vals []Value) []byte {
+    key := make([]Value, 0, len(tdef.Indexes[idx]))
+    for _, col := range tdef.Indexes[idx] {
+        key = append(key, vals[colIndex(tdef, col)])
+    }
+    return encodeKey(nil, tdef.IndexPrefixes[idx], key)
+}
+
+const (
+    INDEX_ADD = 1
+    INDEX_DEL = 2
+)
+
+// add or remove the index entries of a row
+func indexOp(tx *DBTX, tdef *TableDef, vals []Value, op int) error {
+    kvtx, err := txWriter(tx)
+    if err != nil {
+        return err
+    }
+    for i := range tdef.Indexes {
+        key := encodeIndexKey(tdef, i, vals)
+        var err error
+        switch op {
+        case INDEX_ADD:
+            _, err = kvtx.Update(key, nil, MODE_UPSERT)
+        case INDEX_DEL:
+            _, err = kvtx.Del(key)
+        default:
+            panic("bad index op")
+        }
+        if err != nil {
+            return fmt.Errorf("table %s: index %d: %w", tdef.Name, i, err)
+        }
+    }
+    return nil
+}
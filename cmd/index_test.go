@@ -0,0 +1,128 @@
+package cmd
+
+import (
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+// the users table with indexes on (email) and (name, email)
+func usersIndexedDef() *TableDef {
+    tdef := usersDef()
+    tdef.Indexes = [][]string{{"email"}, {"name", "email"}}
+    return tdef
+}
+
+// check that the index entries of a row exist or not
+func indexCheck(t *testing.T, db *DB, tdef *TableDef, rec Record, exists bool) {
+    t.Helper()
+    vals, err := checkRecord(tdef, rec, len(tdef.Cols))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := range tdef.Indexes {
+        _, ok, err := db.kv.Get(encodeIndexKey(tdef, i, vals))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ok != exists {
+            t.Fatalf("index %d of %v: exists = %v, want %v", i, rec.Vals, ok, exists)
+        }
+    }
+}
+
+func TestIndexDef(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openDB(t, path)
+
+    tdef := usersIndexedDef()
+    createTable(t, db, tdef)
+    want := [][]string{{"email", "id"}, {"name", "email", "id"}}
+    if !reflect.DeepEqual(tdef.Indexes, want) {
+        t.Fatalf("bad indexes %v", tdef.Indexes)
+    }
+    p := tdef.Prefix
+    if !reflect.DeepEqual(tdef.IndexPrefixes, []uint32{p + 1, p + 2}) {
+        t.Fatalf("bad index prefixes %v", tdef.IndexPrefixes)
+    }
+    // the next table is after the indexes
+    next := usersDef()
+    next.Name = "next"
+    createTable(t, db, next)
+    if next.Prefix != p + 3 || next.Indexes != nil || next.IndexPrefixes != nil {
+        t.Fatalf("bad table %+v", next)
+    }
+
+    bad := [][][]string{
+        {{}},
+        {{"nope"}},
+        {{"email", "email"}},
+    }
+    for i, indexes := range bad {
+        tdef := usersDef()
+        tdef.Name = "bad"
+        tdef.Indexes = indexes
+        if err := db.TableNew(tdef); err == nil {
+            t.Fatalf("bad index %d accepted", i)
+        }
+    }
+    db.Close()
+
+    db = openDB(t, path)
+    defer db.Close()
+    got, err := getTdef(db, "users")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(got, tdef) {
+        t.Fatalf("got %+v, want %+v", got, tdef)
+    }
+}
+
+func TestIndexUpdate(t *testing.T) {
+    db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+    defer db.Close()
+    tdef := usersIndexedDef()
+    createTable(t, db, tdef)
+
+    alice := userRec(1, "alice", "a@x")
+    bob := userRec(2, "bob", "b@x")
+    for _, rec := range []Record{alice, bob} {
+        if _, err := db.Insert("users", rec); err != nil {
+            t.Fatal(err)
+        }
+        indexCheck(t, db, tdef, rec, true)
+    }
+
+    // a failed insert leaves the indexes alone
+    dup := userRec(1, "carol", "c@x")
+    if ok, err := db.Insert("users", dup); err != nil || ok {
+        t.Fatalf("duplicate insert: %v, %v", ok, err)
+    }
+    indexCheck(t, db, tdef, dup, false)
+    indexCheck(t, db, tdef, alice, true)
+
+    // the old entries are replaced
+    alice2 := userRec(1, "alice", "alice@x")
+    if ok, err := db.Update("users", alice2); err != nil || !ok {
+        t.Fatalf("update: %v, %v", ok, err)
+    }
+    indexCheck(t, db, tdef, alice, false)
+    indexCheck(t, db, tdef, alice2, true)
+    // an unchanged row
+    if ok, err := db.Upsert("users", alice2); err != nil || ok {
+        t.Fatalf("upsert: %v, %v", ok, err)
+    }
+    indexCheck(t, db, tdef, alice2, true)
+
+    // the entries are deleted with the row
+    pk := (&Record{}).AddInt64("id", 1)
+    if ok, err := db.Delete("users", *pk); err != nil || !ok {
+        t.Fatalf("delete: %v, %v", ok, err)
+    }
+    indexCheck(t, db, tdef, alice2, false)
+    indexCheck(t, db, tdef, bob, true)
+    if ok, err := db.Delete("users", *pk); err != nil || ok {
+        t.Fatalf("delete: %v, %v", ok, err)
+    }
+}
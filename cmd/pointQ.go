@@ -1 +1,56 @@
 package cmd
+
+import "fmt"
+
+// Retrieving a record by its primary key (point query)
+// rec holds the primary key columns, the whole row is put back into rec in
+// the order of the table columns when it's found.
+func dbGet(tx *DBTX, tdef *TableDef, rec *Record) (bool, error) {
+    vals, err := checkRecord(tdef, *rec, tdef.PKeys)
+    if err != nil {
+        return false, err
+    }
+    key := encodeKey(nil, tdef.Prefix, vals[:tdef.PKeys])
+    val, ok, err := tx.kv.Get(key)
+    if err != nil || !ok {
+        return false, err
+    }
+    rest, err := decodeRow(tdef, val)
+    if err != nil {
+        return false, err
+    }
+    rec.Cols = append([]string{}, tdef.Cols...)
+    rec.Vals = append(vals[:tdef.PKeys:tdef.PKeys], rest...)
+    return true, nil
+}
+
+// decode the non primary key columns stored in the value
+func decodeRow(tdef *TableDef, val []byte) ([]Value, error) {
+    vals, err := decodeValues(val, len(tdef.Cols) - tdef.PKeys)
+    if err != nil {
+        return nil, fmt.Errorf("table %s: %w", tdef.Name, err)
+    }
+    for i, v := range vals {
+        if v.Type != tdef.Types[tdef.PKeys + i] {
+            return nil, fmt.Errorf("table %s: column %s: stored %s, expected %s",
+                tdef.Name, tdef.Cols[tdef.PKeys + i],
+                typeName(v.Type), typeName(tdef.Types[tdef.PKeys + i]))
+        }
+    }
+    return vals, nil
+}
+
+// get a single row by the primary key
+func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
+    tdef, err := tableDefOf(tx, table)
+    if err != nil {
+        return false, err
+    }
+    return dbGet(tx, tdef, rec)
+}
+
+func (db *DB) Get(table string, rec *Record) (bool, error) {
+    tx := db.BeginRead()
+    defer tx.Abort()
+    return tx.Get(table, rec)
+}
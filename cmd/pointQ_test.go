@@ -0,0 +1,50 @@
+package cmd
+
+import (
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestPointQuery(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openDB(t, path)
+    defer db.Close()
+    createTable(t, db, usersDef())
+    for i := int64(0); i < 100; i++ {
+        rec := userRec(i, "user", "mail")
+        rec.Vals[1].Str = append(rec.Vals[1].Str, byte(i))
+        if _, err := db.Insert("users", rec); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    for i := int64(0); i < 100; i++ {
+        rec := (&Record{}).AddInt64("id", i)
+        ok, err := db.Get("users", rec)
+        if err != nil || !ok {
+            t.Fatalf("Get(%d) = %v, %v", i, ok, err)
+        }
+        want := userRec(i, "user", "mail")
+        want.Vals[1].Str = append(want.Vals[1].Str, byte(i))
+        if !reflect.DeepEqual(*rec, want) {
+            t.Fatalf("got %v, want %v", *rec, want)
+        }
+    }
+
+    rec := (&Record{}).AddInt64("id", 100)
+    if ok, err := db.Get("users", rec); err != nil || ok {
+        t.Fatalf("found a missing row: %v, %v", ok, err)
+    }
+    if _, err := db.Get("nope", rec); err == nil {
+        t.Fatal("found a missing table")
+    }
+    bad := (&Record{}).AddStr("id", nil)
+    if _, err := db.Get("users", bad); err == nil {
+        t.Fatal("bad primary key accepted")
+    }
+    full := userRec(1, "a", "b")
+    if _, err := db.Get("users", &full); err == nil {
+        t.Fatal("non primary key columns accepted")
+    }
+}
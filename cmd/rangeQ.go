@@ -1,11 +1,236 @@
 package cmd
 
+import (
+    "fmt"
+
+    "github.com/IAmRiteshKoushik/db-dev/btree"
+)
+
 // Retriving a range of records (range query)
+// The ordered iterator over the B+tree lives in the btree package (BIter)
+
+// comparison operators for the range, see btree.Seek()
+const (
+    CMP_GE = btree.CMP_GE // >=
+    CMP_GT = btree.CMP_GT // >
+    CMP_LT = btree.CMP_LT // <
+    CMP_LE = btree.CMP_LE // <=
+)
+
+// the range Key1 Cmp1 x Cmp2 Key2
+// The keys hold a prefix of the columns of either the primary key or an
+// index, an empty key is unbounded. The scan goes forward if Cmp1 is > or
+// >=, and backward if Cmp1 is < or <=.
+type Scanner struct {
+    Cmp1 int
+    Cmp2 int
+    Key1 Record
+    Key2 Record
+    // internal
+    tx *DBTX
+    tdef *TableDef
+    index int // -1: the primary key, otherwise the index used
+    iter *btree.KVIter
+    keyEnd []byte // the encoded Key2
+    owned *DBTX // the read-only transaction started by DB.Scan()
+}
+
+// within the range or not
+func (sc *Scanner) Valid() bool {
+    if !sc.iter.Valid() {
+        return false
+    }
+    key, _ := sc.iter.Deref()
+    return btree.CmpOK(key, sc.Cmp2, sc.keyEnd)
+}
 
-type BIter struct {
-    tree *BTree
-    path []BNode // from root to leaf
-    pos []uint16 // indexes into nodes
+// move the underlying B-tree iterator
+func (sc *Scanner) Next() {
+    if sc.Cmp1 > 0 {
+        sc.iter.Next()
+    } else {
+        sc.iter.Prev()
+    }
 }
 
+// the error that stopped the scan
+func (sc *Scanner) Err() error {
+    return sc.iter.Err()
+}
+
+// end the scan, only needed for DB.Scan()
+func (sc *Scanner) Close() {
+    if sc.owned != nil {
+        sc.owned.Abort()
+        sc.owned = nil
+    }
+}
+
+// fetch the current row
+// The row is decoded from the KV pair for a primary key scan. For an index
+// scan, the primary key is taken from the index key and the row is fetched.
+func (sc *Scanner) Deref(rec *Record) error {
+    if !sc.Valid() {
+        panic("deref of an invalid scanner")
+    }
+    tdef := sc.tdef
+    key, val := sc.iter.Deref()
+    if sc.index < 0 {
+        pkey, err := decodeValues(key[4:], tdef.PKeys)
+        if err != nil {
+            return fmt.Errorf("table %s: %w", tdef.Name, err)
+        }
+        rest, err := decodeRow(tdef, val)
+        if err != nil {
+            return err
+        }
+        rec.Cols = append([]string{}, tdef.Cols...)
+        rec.Vals = append(pkey, rest...)
+        return nil
+    }
+
+    index := tdef.Indexes[sc.index]
+    ivals, err := decodeValues(key[4:], len(index))
+    if err != nil {
+        return fmt.Errorf("table %s: index %d: %w", tdef.Name, sc.index, err)
+    }
+    *rec = Record{}
+    for i, col := range index {
+        if colIndex(tdef, col) < tdef.PKeys {
+            rec.Cols = append(rec.Cols, col)
+            rec.Vals = append(rec.Vals, ivals[i])
+        }
+    }
+    ok, err := dbGet(sc.tx, tdef, rec)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        return fmt.Errorf("table %s: index %d: the row is missing", tdef.Name, sc.index)
+    }
+    return nil
+}
 
+// find the index that has the columns of the keys as a prefix
+// returns -1 for the primary key, -2 for no match
+func findIndex(tdef *TableDef, keys ...[]string) int {
+    cols := append([][]string{tdef.Cols[:tdef.PKeys]}, tdef.Indexes...)
+    for i, index := range cols {
+        match := true
+        for _, key := range keys {
+            match = match && isPrefix(index, key)
+        }
+        if match {
+            return i - 1
+        }
+    }
+    return -2
+}
+
+// the key columns in any order are the first columns of the index
+func isPrefix(index []string, key []string) bool {
+    if len(key) > len(index) {
+        return false
+    }
+    set := map[string]bool{}
+    for _, col := range key {
+        set[col] = true
+    }
+    if len(set) != len(key) {
+        return false // duplicate columns
+    }
+    for _, col := range index[:len(key)] {
+        if !set[col] {
+            return false
+        }
+    }
+    return true
+}
+
+// encode a key of the range
+// The key can be a prefix of the index columns. The keys sharing the prefix
+// are all greater than the prefix itself, so for > and <=, the prefix is
+// padded with 0xff to be after them. This works since every encoded column
+// starts with a type byte that is less than 0xff.
+func encodeKeyRange(tdef *TableDef, index int, rec Record, cmp int) ([]byte, error) {
+    cols, prefix := tdef.Cols[:tdef.PKeys], tdef.Prefix
+    if index >= 0 {
+        cols, prefix = tdef.Indexes[index], tdef.IndexPrefixes[index]
+    }
+    if len(rec.Cols) != len(rec.Vals) {
+        return nil, fmt.Errorf("record has %d columns and %d values",
+            len(rec.Cols), len(rec.Vals))
+    }
+    vals := []Value{}
+    for _, col := range cols[:len(rec.Cols)] {
+        v := rec.Get(col)
+        if typ := tdef.Types[colIndex(tdef, col)]; v.Type != typ {
+            return nil, fmt.Errorf("table %s: column %s: expected %s, got %s",
+                tdef.Name, col, typeName(typ), typeName(v.Type))
+        }
+        vals = append(vals, *v)
+    }
+    key := encodeKey(nil, prefix, vals)
+    if cmp == CMP_GT || cmp == CMP_LE {
+        key = append(key, 0xff)
+    }
+    return key, nil
+}
+
+func dbScan(tx *DBTX, tdef *TableDef, req *Scanner) error {
+    // check the range
+    switch {
+    case req.Cmp1 > 0 && req.Cmp2 < 0:
+    case req.Cmp1 < 0 && req.Cmp2 > 0:
+    default:
+        return fmt.Errorf("bad range")
+    }
+    for _, cmp := range []int{req.Cmp1, req.Cmp2} {
+        switch cmp {
+        case CMP_GE, CMP_GT, CMP_LT, CMP_LE:
+        default:
+            return fmt.Errorf("bad range")
+        }
+    }
+    index := findIndex(tdef, req.Key1.Cols, req.Key2.Cols)
+    if index < -1 {
+        return fmt.Errorf("table %s: no index for the range", tdef.Name)
+    }
+    keyStart, err := encodeKeyRange(tdef, index, req.Key1, req.Cmp1)
+    if err != nil {
+        return err
+    }
+    keyEnd, err := encodeKeyRange(tdef, index, req.Key2, req.Cmp2)
+    if err != nil {
+        return err
+    }
+
+    req.tx = tx
+    req.tdef = tdef
+    req.index = index
+    req.iter = tx.kv.Seek(keyStart, req.Cmp1)
+    req.keyEnd = keyEnd
+    return req.iter.Err()
+}
+
+// start a range scan
+// The scanner must not be used after the transaction is done.
+func (tx *DBTX) Scan(table string, req *Scanner) error {
+    tdef, err := tableDefOf(tx, table)
+    if err != nil {
+        return err
+    }
+    return dbScan(tx, tdef, req)
+}
+
+// the same as above, in a read-only transaction that ends with
+// Scanner.Close()
+func (db *DB) Scan(table string, req *Scanner) error {
+    tx := db.BeginRead()
+    if err := tx.Scan(table, req); err != nil {
+        tx.Abort()
+        return err
+    }
+    req.owned = tx
+    return nil
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+    "errors"
+    "fmt"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/IAmRiteshKoushik/db-dev/btree"
+)
+
+// the ids of the rows in the range
+func scanIDs(t *testing.T, db *DB, sc *Scanner) []int64 {
+    t.Helper()
+    if err := db.Scan("users", sc); err != nil {
+        t.Fatal(err)
+    }
+    defer sc.Close()
+    ids := []int64{}
+    for ; sc.Valid(); sc.Next() {
+        rec := Record{}
+        if err := sc.Deref(&rec); err != nil {
+            t.Fatal(err)
+        }
+        want := userRec(rec.Get("id").I64, "", "")
+        want.Vals[1] = *rec.Get("name")
+        want.Vals[2] = *rec.Get("email")
+        if fmt.Sprint(rec) != fmt.Sprint(want) {
+            t.Fatalf("bad row %v", rec)
+        }
+        ids = append(ids, rec.Get("id").I64)
+    }
+    if err := sc.Err(); err != nil {
+        t.Fatal(err)
+    }
+    return ids
+}
+
+func TestScan(t *testing.T) {
+    db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+    defer db.Close()
+    createTable(t, db, usersIndexedDef())
+    // another table with the next prefix, which the scans must not reach
+    next := usersDef()
+    next.Name = "next"
+    createTable(t, db, next)
+    for i := int64(-5); i < 5; i++ {
+        if _, err := db.Insert("next", userRec(i, "x", "x")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // ids from -10 to 9, names from n0 to n4, emails in the reverse order
+    for i := int64(-10); i < 10; i++ {
+        rec := userRec(i, fmt.Sprintf("n%d", (i + 10) % 5), fmt.Sprintf("e%02d", 9 - i))
+        if _, err := db.Insert("users", rec); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    check := func(sc Scanner, want ...int64) {
+        t.Helper()
+        got := scanIDs(t, db, &sc)
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Fatalf("got %v, want %v", got, want)
+        }
+    }
+    id := func(i int64) Record { return *(&Record{}).AddInt64("id", i) }
+    email := func(s string) Record { return *(&Record{}).AddStr("email", []byte(s)) }
+    name := func(s string) Record { return *(&Record{}).AddStr("name", []byte(s)) }
+
+    // the primary key
+    check(Scanner{Cmp1: CMP_GE, Key1: id(-2), Cmp2: CMP_LE, Key2: id(2)}, -2, -1, 0, 1, 2)
+    check(Scanner{Cmp1: CMP_GT, Key1: id(-2), Cmp2: CMP_LT, Key2: id(2)}, -1, 0, 1)
+    check(Scanner{Cmp1: CMP_LE, Key1: id(2), Cmp2: CMP_GT, Key2: id(-1)}, 2, 1, 0)
+    check(Scanner{Cmp1: CMP_GE, Key1: id(8), Cmp2: CMP_LE, Key2: Record{}}, 8, 9)
+    check(Scanner{Cmp1: CMP_LT, Key1: id(-8), Cmp2: CMP_GE, Key2: Record{}}, -9, -10)
+    check(Scanner{Cmp1: CMP_GT, Key1: id(9), Cmp2: CMP_LE, Key2: Record{}})
+    all := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+    if got := scanIDs(t, db, &all); len(got) != 20 || got[0] != -10 || got[19] != 9 {
+        t.Fatalf("full scan got %v", got)
+    }
+
+    // an index
+    check(Scanner{Cmp1: CMP_GE, Key1: email("e17"), Cmp2: CMP_LT, Key2: email("e2")}, -8, -9, -10)
+    check(Scanner{Cmp1: CMP_GT, Key1: email("e00"), Cmp2: CMP_LE, Key2: email("e02")}, 8, 7)
+    // a prefix of an index
+    check(Scanner{Cmp1: CMP_GE, Key1: name("n3"), Cmp2: CMP_LE, Key2: name("n3")}, 8, 3, -2, -7)
+    check(Scanner{Cmp1: CMP_GT, Key1: name("n3"), Cmp2: CMP_LE, Key2: Record{}}, 9, 4, -1, -6)
+    check(Scanner{Cmp1: CMP_LT, Key1: name("n1"), Cmp2: CMP_GE, Key2: Record{}}, -10, -5, 0, 5)
+    // the columns in any order
+    ne := *(&Record{}).AddStr("email", []byte("e01")).AddStr("name", []byte("n3"))
+    check(Scanner{Cmp1: CMP_GE, Key1: ne, Cmp2: CMP_LE, Key2: ne}, 8)
+
+    bad := []Scanner{
+        {Cmp1: CMP_GE, Cmp2: CMP_GT},
+        {Cmp1: CMP_LT, Cmp2: CMP_LE},
+        {Cmp1: 0, Cmp2: CMP_LE},
+        {Cmp1: CMP_GE, Key1: email("a"), Cmp2: CMP_LE, Key2: id(1)},
+        {Cmp1: CMP_GE, Key1: *(&Record{}).AddStr("id", nil), Cmp2: CMP_LE},
+        {Cmp1: CMP_GE, Key1: *(&Record{}).AddInt64("id", 1).AddInt64("id", 2), Cmp2: CMP_LE},
+        {Cmp1: CMP_GE, Key1: *(&Record{}).AddStr("nope", nil), Cmp2: CMP_LE},
+    }
+    for i, sc := range bad {
+        if err := db.Scan("users", &sc); err == nil {
+            t.Fatalf("bad scanner %d accepted", i)
+        }
+    }
+    if err := db.Scan("nope", &all); err == nil {
+        t.Fatal("scanned a missing table")
+    }
+}
+
+// the scans that run to the end of the tree, the table with the last prefix
+// is large enough for a tree of 3 levels
+func TestScanEnd(t *testing.T) {
+    db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+    defer db.Close()
+    createTable(t, db, usersDef())
+    tx := db.Begin()
+    for i := int64(0); i < 1000; i++ {
+        if _, err := tx.Insert("users", userRec(i, strings.Repeat("x", 2000), "e")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+
+    id := func(i int64) Record { return *(&Record{}).AddInt64("id", i) }
+    cases := []struct {
+        sc Scanner
+        want string
+    }{
+        {Scanner{Cmp1: CMP_GT, Key1: id(990), Cmp2: CMP_LE, Key2: Record{}},
+            "[991 992 993 994 995 996 997 998 999]"},
+        {Scanner{Cmp1: CMP_LT, Key1: id(9), Cmp2: CMP_GE, Key2: Record{}},
+            "[8 7 6 5 4 3 2 1 0]"},
+    }
+    for _, c := range cases {
+        if got := fmt.Sprint(scanIDs(t, db, &c.sc)); got != c.want {
+            t.Fatalf("got %s, want %s", got, c.want)
+        }
+    }
+}
+
+// a scanner stops with an error when the DB is closed under it
+func TestScanClosed(t *testing.T) {
+    db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+    createTable(t, db, usersDef())
+    for i := int64(0); i < 10; i++ {
+        if _, err := db.Insert("users", userRec(i, "n", "e")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+    if err := db.Scan("users", &sc); err != nil {
+        t.Fatal(err)
+    }
+    defer sc.Close()
+    db.Close()
+    sc.Next()
+    if sc.Valid() || !errors.Is(sc.Err(), btree.ErrClosed) {
+        t.Fatalf("scanner after Close: %v", sc.Err())
+    }
+}
@@ -1 +1,98 @@
 package cmd
+
+import (
+    "errors"
+
+    "github.com/IAmRiteshKoushik/db-dev/btree"
+)
+
+// the KV reads used by the tables
+// Implemented by both the KV transaction and the KV reader.
+type kvReader interface {
+    Get(key []byte) ([]byte, bool, error)
+    Seek(key []byte, cmp int) *btree.KVIter
+}
+
+// returned by an update in a read-only transaction
+var ErrReadOnly = errors.New("DB: read-only transaction")
+
+// returned by Commit() when the transaction should be retried, see btree.KVTX
+var ErrConflict = btree.ErrConflict
+
+// DB transaction
+// A row and its index entries are updated in a single KV transaction, so
+// they are committed together. All transactions read their own snapshots
+// and can run at the same time, a read-write transaction fails to commit
+// with btree.ErrConflict if what it read was updated by another commit in
+// the meantime, see btree.KVTX and btree.KVReader.
+type DBTX struct {
+    kv kvReader
+    kvtx *btree.KVTX // nil for a read-only transaction
+    reader *btree.KVReader // nil for a read-write transaction
+    db *DB
+    // the table definitions read by a read-write transaction, they can be
+    // its own updates, so they are cached only after the commit
+    tables map[string]*TableDef
+}
+
+// begin a transaction
+func (db *DB) Begin() *DBTX {
+    kvtx := db.kv.Begin()
+    return &DBTX{kv: kvtx, kvtx: kvtx, db: db, tables: map[string]*TableDef{}}
+}
+
+// begin a read-only transaction
+// It must be ended by Commit() or Abort(), which are the same for it.
+func (db *DB) BeginRead() *DBTX {
+    reader := db.kv.BeginRead()
+    return &DBTX{kv: reader, reader: reader, db: db}
+}
+
+// end a transaction: commit updates
+func (tx *DBTX) Commit() error {
+    if tx.kvtx == nil {
+        tx.reader.Close()
+        return nil
+    }
+    if err := tx.kvtx.Commit(); err != nil {
+        return err
+    }
+    tx.db.mu.Lock()
+    for name, tdef := range tx.tables {
+        tx.db.tables[name] = tdef
+    }
+    tx.db.mu.Unlock()
+    return nil
+}
+
+// end a transaction: rollback
+func (tx *DBTX) Abort() {
+    if tx.kvtx == nil {
+        tx.reader.Close()
+        return
+    }
+    tx.kvtx.Abort()
+}
+
+// the transaction for the updates
+func txWriter(tx *DBTX) (*btree.KVTX, error) {
+    if tx.kvtx == nil {
+        return nil, ErrReadOnly
+    }
+    return tx.kvtx, nil
+}
+
+// run the updates in a transaction, commit if there is no error
+// The whole transaction is run again on a conflict.
+func dbWrite(db *DB, fn func(tx *DBTX) error) error {
+    for {
+        tx := db.Begin()
+        if err := fn(tx); err != nil {
+            tx.Abort()
+            return err
+        }
+        if err := tx.Commit(); err != ErrConflict {
+            return err
+        }
+    }
+}
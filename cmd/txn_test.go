@@ -0,0 +1,213 @@
+package cmd
+
+import (
+    "fmt"
+    "path/filepath"
+    "sync"
+    "testing"
+
+    "github.com/IAmRiteshKoushik/db-dev/btree"
+)
+
+func TestDBTX(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.db")
+    db := openDB(t, path)
+    tdef := usersIndexedDef()
+    createTable(t, db, tdef)
+
+    // aborted
+    tx := db.Begin()
+    lost := userRec(1, "lost", "lost@x")
+    if _, err := tx.Insert("users", lost); err != nil {
+        t.Fatal(err)
+    }
+    rec := (&Record{}).AddInt64("id", 1)
+    if ok, err := tx.Get("users", rec); err != nil || !ok {
+        t.Fatalf("the transaction can't see its update: %v, %v", ok, err)
+    }
+    tx.Abort()
+    rec = (&Record{}).AddInt64("id", 1)
+    if ok, err := db.Get("users", rec); err != nil || ok {
+        t.Fatalf("aborted row found: %v, %v", ok, err)
+    }
+    indexCheck(t, db, tdef, lost, false)
+
+    // committed
+    tx = db.Begin()
+    recs := []Record{userRec(1, "a", "a@x"), userRec(2, "b", "b@x"), userRec(3, "c", "c@x")}
+    for _, rec := range recs {
+        if _, err := tx.Insert("users", rec); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if ok, err := tx.Delete("users", *(&Record{}).AddInt64("id", 2)); err != nil || !ok {
+        t.Fatalf("delete: %v, %v", ok, err)
+    }
+    sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+    if err := tx.Scan("users", &sc); err != nil {
+        t.Fatal(err)
+    }
+    n := 0
+    for ; sc.Valid(); sc.Next() {
+        n++
+    }
+    if n != 2 {
+        t.Fatalf("scanned %d rows in the transaction", n)
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+
+    db = openDB(t, path)
+    defer db.Close()
+    indexCheck(t, db, tdef, recs[0], true)
+    indexCheck(t, db, tdef, recs[1], false)
+    indexCheck(t, db, tdef, recs[2], true)
+
+    // the row is not added if an index entry can't be
+    big := userRec(4, "d", string(make([]byte, 1000)))
+    if _, err := db.Insert("users", big); err == nil {
+        t.Fatal("index key too large accepted")
+    }
+    if ok, err := db.Get("users", (&Record{}).AddInt64("id", 4)); err != nil || ok {
+        t.Fatalf("row without index entries: %v, %v", ok, err)
+    }
+}
+
+func TestDBReadOnly(t *testing.T) {
+    db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+    defer db.Close()
+    createTable(t, db, usersIndexedDef())
+    if _, err := db.Insert("users", userRec(1, "a", "a@x")); err != nil {
+        t.Fatal(err)
+    }
+
+    tx := db.BeginRead()
+    if _, err := tx.Insert("users", userRec(2, "b", "b@x")); err != ErrReadOnly {
+        t.Fatalf("got %v for an update", err)
+    }
+    if _, err := tx.Delete("users", *(&Record{}).AddInt64("id", 1)); err != ErrReadOnly {
+        t.Fatalf("got %v for a delete", err)
+    }
+
+    // the snapshot is not affected by the later updates
+    var wg sync.WaitGroup
+    errs := make(chan error, 1)
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for i := int64(2); i < 50; i++ {
+            if _, err := db.Insert("users", userRec(i, "b", "b@x")); err != nil {
+                errs <- err
+                return
+            }
+            if _, err := db.Update("users", userRec(1, "a", fmt.Sprintf("a%d@x", i))); err != nil {
+                errs <- err
+                return
+            }
+        }
+    }()
+    for i := 0; i < 20; i++ {
+        rec := (&Record{}).AddInt64("id", 1)
+        if ok, err := tx.Get("users", rec); err != nil || !ok || string(rec.Get("email").Str) != "a@x" {
+            t.Fatalf("got %v, %v, %v", rec, ok, err)
+        }
+        sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+        if err := tx.Scan("users", &sc); err != nil {
+            t.Fatal(err)
+        }
+        n := 0
+        for ; sc.Valid(); sc.Next() {
+            n++
+        }
+        if n != 1 {
+            t.Fatalf("scanned %d rows", n)
+        }
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Fatal(err)
+    }
+    tx.Abort()
+
+    sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+    if err := db.Scan("users", &sc); err != nil {
+        t.Fatal(err)
+    }
+    defer sc.Close()
+    n := 0
+    for ; sc.Valid(); sc.Next() {
+        n++
+    }
+    if n != 49 {
+        t.Fatalf("scanned %d rows", n)
+    }
+}
+
+func TestDBConflict(t *testing.T) {
+    db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+    defer db.Close()
+    tdef := usersIndexedDef()
+    createTable(t, db, tdef)
+    if _, err := db.Insert("users", userRec(1, "a", "a@x")); err != nil {
+        t.Fatal(err)
+    }
+
+    // both update the row they read, the second commit fails
+    tx1, tx2 := db.Begin(), db.Begin()
+    for i, tx := range []*DBTX{tx1, tx2} {
+        rec := (&Record{}).AddInt64("id", 1)
+        if ok, err := tx.Get("users", rec); err != nil || !ok {
+            t.Fatalf("got %v, %v", ok, err)
+        }
+        email := fmt.Sprintf("%s%d@x", rec.Get("name").Str, i)
+        if _, err := tx.Update("users", userRec(1, "a", email)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := tx1.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if err := tx2.Commit(); err != btree.ErrConflict {
+        t.Fatalf("got %v", err)
+    }
+    indexCheck(t, db, tdef, userRec(1, "a", "a0@x"), true)
+    indexCheck(t, db, tdef, userRec(1, "a", "a1@x"), false)
+
+    // the DB methods retry, no update is lost
+    var wg sync.WaitGroup
+    errs := make(chan error, 4)
+    for w := 0; w < 4; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for i := int64(0); i < 25; i++ {
+                id := 100 + int64(w) * 25 + i
+                if _, err := db.Insert("users", userRec(id, "b", fmt.Sprintf("b%d@x", id))); err != nil {
+                    errs <- err
+                    return
+                }
+            }
+        }(w)
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Fatal(err)
+    }
+    sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: *(&Record{}).AddStr("name", []byte("b")),
+        Key2: *(&Record{}).AddStr("name", []byte("b"))}
+    if err := db.Scan("users", &sc); err != nil {
+        t.Fatal(err)
+    }
+    defer sc.Close()
+    n := 0
+    for ; sc.Valid(); sc.Next() {
+        n++
+    }
+    if n != 100 {
+        t.Fatalf("scanned %d rows", n)
+    }
+}
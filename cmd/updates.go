@@ -1,40 +1,89 @@
 package cmd
 
-// operation modes
-const(
-    MODE_UPSERT      = 0 // insert or replace
-    MODE_UPDATE_ONLY = 1 // update existing keys   
-    MODE_INSERT_ONLY = 2 // only add new keys
+import(
+    "github.com/IAmRiteshKoushik/db-dev/btree"
 )
 
-type InsertReq struct { tree    *BTree
-    // out
-    Added   bool // added a new key
-    // in
-    Key     []byte
-    Val     []byte
-    Mode    int
-}
-
-func (tree *BTree) InsertEx(req *InsertReq)
-func (db *KV) Update(key []byte, val []byte, mode int) (bool, error)
+// operation modes, see btree.InsertEx()
+const(
+    MODE_UPSERT      = btree.MODE_UPSERT      // insert or replace
+    MODE_UPDATE_ONLY = btree.MODE_UPDATE_ONLY // update existing keys
+    MODE_INSERT_ONLY = btree.MODE_INSERT_ONLY // only add new keys
+)
 
 // add a row to the table
-func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int) (bool, error) {
+// The row is stored as a single KV pair:
+// key: | prefix | primary key columns |
+// val: | the rest of the columns |
+// The index entries of the old row are replaced by the ones of the new row.
+func dbUpdate(tx *DBTX, tdef *TableDef, rec Record, mode int) (bool, error) {
+    kvtx, err := txWriter(tx)
+    if err != nil {
+        return false, err
+    }
+    vals, err := checkRecord(tdef, rec, len(tdef.Cols))
+    if err != nil {
+        return false, err
+    }
+    key := encodeKey(nil, tdef.Prefix, vals[:tdef.PKeys])
+    val := encodeValues(nil, vals[tdef.PKeys:])
+    req := &btree.InsertReq{Key: key, Val: val, Mode: mode}
+    if err := kvtx.InsertEx(req); err != nil {
+        return false, err
+    }
+    if !req.Updated || len(tdef.Indexes) == 0 {
+        return req.Updated, nil
+    }
 
+    // maintain the indexes
+    if !req.Added {
+        rest, err := decodeRow(tdef, req.Old)
+        if err != nil {
+            return false, err
+        }
+        old := append(vals[:tdef.PKeys:tdef.PKeys], rest...)
+        if err := indexOp(tx, tdef, old, INDEX_DEL); err != nil {
+            return false, err
+        }
+    }
+    if err := indexOp(tx, tdef, vals, INDEX_ADD); err != nil {
+        return false, err
+    }
+    return true, nil
 }
 
 // add a record 
-func (db *DB) Set(table string, rec Record, mode int) (bool, error) {
+func (tx *DBTX) Set(table string, rec Record, mode int) (bool, error) {
+    tdef, err := tableDefWrite(tx, table)
+    if err != nil {
+        return false, err
+    }
+    return dbUpdate(tx, tdef, rec, mode)
+}
+func (tx *DBTX) Insert(table string, rec Record) (bool, error) {
+    return tx.Set(table, rec, MODE_INSERT_ONLY)
+}
+func (tx *DBTX) Update(table string, rec Record) (bool, error) {
+    return tx.Set(table, rec, MODE_UPDATE_ONLY)
+}
+func (tx *DBTX) Upsert(table string, rec Record) (bool, error) {
+    return tx.Set(table, rec, MODE_UPSERT)
+}
 
+// the same as above, each in a transaction on its own
+func (db *DB) Set(table string, rec Record, mode int) (updated bool, err error) {
+    err = dbWrite(db, func(tx *DBTX) error {
+        updated, err = tx.Set(table, rec, mode)
+        return err
+    })
+    return updated, err
 }
 func (db *DB) Insert(table string, rec Record) (bool, error) {
-
+    return db.Set(table, rec, MODE_INSERT_ONLY)
 }
 func (db *DB) Update(table string, rec Record) (bool, error) {
-
+    return db.Set(table, rec, MODE_UPDATE_ONLY)
 }
 func (db *DB) Upsert(table string, rec Record) (bool, error) {
-
+    return db.Set(table, rec, MODE_UPSERT)
 }
-
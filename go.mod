@@ -1,3 +1,7 @@
 module github.com/IAmRiteshKoushik/db-dev
 
 go 1.22.1
+
+require golang.org/x/term v0.28.0
+
+require golang.org/x/sys v0.29.0 // indirect
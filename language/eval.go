@@ -0,0 +1,218 @@
+package parser
+
+import (
+    "bytes"
+    "fmt"
+
+    "github.com/IAmRiteshKoushik/db-dev/cmd"
+)
+
+// evaluate an expression against a row
+// The columns are looked up in the row, which can be nil for the constant
+// expressions. The booleans are INT64, 0 is false and anything else is true.
+// The arithmetic is on INT64, and + also concatenates BYTES. The operands of
+// a comparison must be of the same type. A type error or a division by zero
+// is returned as an error.
+func qlEval(env *cmd.Record, node QLNode) (cmd.Value, error) {
+    switch node.Type {
+    case QL_I64, QL_STR:
+        return node.Value, nil
+    case QL_SYM:
+        return qlColumn(env, string(node.Str))
+    case QL_CMP_GE, QL_CMP_GT, QL_CMP_LT, QL_CMP_LE, QL_CMP_EQ, QL_CMP_NE:
+        left, right, err := qlEvalKids(env, node)
+        if err != nil {
+            return cmd.Value{}, err
+        }
+        if left.Type != right.Type {
+            return cmd.Value{}, qlTypeErr(node, left, right)
+        }
+        return qlBool(qlCmpOK(node.Type, qlCompare(left, right))), nil
+    case QL_AND, QL_OR:
+        // both sides are evaluated, so the type errors are not hidden
+        left, right, err := qlEvalKids(env, node)
+        if err != nil {
+            return cmd.Value{}, err
+        }
+        if left.Type != cmd.TYPE_INT64 || right.Type != cmd.TYPE_INT64 {
+            return cmd.Value{}, qlTypeErr(node, left, right)
+        }
+        if node.Type == QL_AND {
+            return qlBool(left.I64 != 0 && right.I64 != 0), nil
+        }
+        return qlBool(left.I64 != 0 || right.I64 != 0), nil
+    case QL_ADD, QL_SUB, QL_MUL, QL_DIV, QL_MOD:
+        left, right, err := qlEvalKids(env, node)
+        if err != nil {
+            return cmd.Value{}, err
+        }
+        if node.Type == QL_ADD && left.Type == cmd.TYPE_BYTES && right.Type == cmd.TYPE_BYTES {
+            str := append(append([]byte{}, left.Str...), right.Str...)
+            return cmd.Value{Type: cmd.TYPE_BYTES, Str: str}, nil
+        }
+        if left.Type != cmd.TYPE_INT64 || right.Type != cmd.TYPE_INT64 {
+            return cmd.Value{}, qlTypeErr(node, left, right)
+        }
+        return qlArith(node.Type, left.I64, right.I64)
+    case QL_NEG:
+        val, err := qlEval(env, node.Kids[0])
+        if err != nil {
+            return cmd.Value{}, err
+        }
+        if val.Type != cmd.TYPE_INT64 {
+            return cmd.Value{}, qlTypeErr(node, val)
+        }
+        return cmd.Value{Type: cmd.TYPE_INT64, I64: -val.I64}, nil
+    case QL_NOT:
+        val, err := qlEval(env, node.Kids[0])
+        if err != nil {
+            return cmd.Value{}, err
+        }
+        if val.Type != cmd.TYPE_INT64 {
+            return cmd.Value{}, qlTypeErr(node, val)
+        }
+        return qlBool(val.I64 == 0), nil
+    case QL_TUP:
+        return cmd.Value{}, fmt.Errorf("a tuple is not a value")
+    case QL_STAR:
+        return cmd.Value{}, fmt.Errorf("* is not a value")
+    default:
+        return cmd.Value{}, fmt.Errorf("unsupported expression: %s", qlOpName(node.Type))
+    }
+}
+
+func qlEvalKids(env *cmd.Record, node QLNode) (cmd.Value, cmd.Value, error) {
+    left, err := qlEval(env, node.Kids[0])
+    if err != nil {
+        return cmd.Value{}, cmd.Value{}, err
+    }
+    right, err := qlEval(env, node.Kids[1])
+    if err != nil {
+        return cmd.Value{}, cmd.Value{}, err
+    }
+    return left, right, nil
+}
+
+// the integer arithmetic wraps around on overflow like Go
+func qlArith(op uint32, a int64, b int64) (cmd.Value, error) {
+    val := cmd.Value{Type: cmd.TYPE_INT64}
+    switch op {
+    case QL_ADD:
+        val.I64 = a + b
+    case QL_SUB:
+        val.I64 = a - b
+    case QL_MUL:
+        val.I64 = a * b
+    case QL_DIV, QL_MOD:
+        if b == 0 {
+            return cmd.Value{}, fmt.Errorf("division by zero")
+        }
+        if op == QL_DIV {
+            val.I64 = a / b
+        } else {
+            val.I64 = a % b
+        }
+    default:
+        panic("qlArith: bad operator")
+    }
+    return val, nil
+}
+
+// the value of a column in the row
+func qlColumn(env *cmd.Record, name string) (cmd.Value, error) {
+    if env != nil {
+        if val := env.Get(name); val != nil {
+            return *val, nil
+        }
+    }
+    return cmd.Value{}, fmt.Errorf("unknown column: %s", name)
+}
+
+// the result of a condition
+func qlTruth(env *cmd.Record, node QLNode) (bool, error) {
+    val, err := qlEval(env, node)
+    if err != nil {
+        return false, err
+    }
+    if val.Type != cmd.TYPE_INT64 {
+        return false, fmt.Errorf("expected a condition, got %s", qlTypeName(val.Type))
+    }
+    return val.I64 != 0, nil
+}
+
+func qlBool(b bool) cmd.Value {
+    val := cmd.Value{Type: cmd.TYPE_INT64}
+    if b {
+        val.I64 = 1
+    }
+    return val
+}
+
+// -1, 0 or +1 for the values of the same type
+func qlCompare(left cmd.Value, right cmd.Value) int {
+    if left.Type == cmd.TYPE_BYTES {
+        return bytes.Compare(left.Str, right.Str)
+    }
+    switch {
+    case left.I64 < right.I64:
+        return -1
+    case left.I64 > right.I64:
+        return +1
+    default:
+        return 0
+    }
+}
+
+func qlCmpOK(op uint32, r int) bool {
+    switch op {
+    case QL_CMP_GE:
+        return r >= 0
+    case QL_CMP_GT:
+        return r > 0
+    case QL_CMP_LT:
+        return r < 0
+    case QL_CMP_LE:
+        return r <= 0
+    case QL_CMP_EQ:
+        return r == 0
+    case QL_CMP_NE:
+        return r != 0
+    default:
+        panic("qlCmpOK: bad operator")
+    }
+}
+
+// the operator names used in the error messages
+var qlOpNames = map[uint32]string{
+    QL_CMP_GE: ">=", QL_CMP_GT: ">", QL_CMP_LT: "<", QL_CMP_LE: "<=",
+    QL_CMP_EQ: "=", QL_CMP_NE: "!=", QL_ADD: "+", QL_SUB: "-", QL_MUL: "*",
+    QL_DIV: "/", QL_MOD: "%", QL_AND: "AND", QL_OR: "OR", QL_NOT: "NOT",
+    QL_NEG: "-", QL_TUP: "tuple", QL_STAR: "*",
+}
+
+func qlOpName(op uint32) string {
+    if name, ok := qlOpNames[op]; ok {
+        return name
+    }
+    return fmt.Sprintf("node(%d)", op)
+}
+
+func qlTypeName(typ uint32) string {
+    switch typ {
+    case cmd.TYPE_BYTES:
+        return "BYTES"
+    case cmd.TYPE_INT64:
+        return "INT64"
+    default:
+        return fmt.Sprintf("type(%d)", typ)
+    }
+}
+
+// the operands don't fit the operator
+func qlTypeErr(node QLNode, vals ...cmd.Value) error {
+    if len(vals) == 1 {
+        return fmt.Errorf("type error: %s %s", qlOpName(node.Type), qlTypeName(vals[0].Type))
+    }
+    return fmt.Errorf("type error: %s %s %s",
+        qlTypeName(vals[0].Type), qlOpName(node.Type), qlTypeName(vals[1].Type))
+}
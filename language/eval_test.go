@@ -0,0 +1,97 @@
+package parser
+
+import (
+    "math"
+    "strings"
+    "testing"
+
+    "github.com/IAmRiteshKoushik/db-dev/cmd"
+)
+
+func evalStr(env *cmd.Record, input string) (cmd.Value, error) {
+    node, err := parseExpr(input)
+    if err != nil {
+        return cmd.Value{}, err
+    }
+    return qlEval(env, node)
+}
+
+func TestEval(t *testing.T) {
+    env := (&cmd.Record{}).AddInt64("a", 7).AddInt64("b", -2).AddStr("s", []byte("xy"))
+    ints := map[string]int64{
+        "1 + 2 * 3": 7,
+        "(1 + 2) * 3": 9,
+        "a - b - 1": 8,
+        "a / b": -3,
+        "a % b": 1,
+        "-a % 4": -3,
+        "--a": 7,
+        "-(a + b)": -5,
+        "a > b": 1,
+        "a <= b": 0,
+        "a = 7 and b = -2": 1,
+        "a = 7 and b = 2": 0,
+        "a = 0 or b < 0": 1,
+        "not a = 7": 0,
+        "not 0": 1,
+        "s = 'xy'": 1,
+        "s < 'xz' and s > 'x'": 1,
+        "s + 'z' = 'xyz'": 1,
+        "s + '' != s": 0,
+        "a != 7 or not (b > 0 or s = '')": 1,
+        "9223372036854775807 + 1 = -9223372036854775807 - 1": 1,
+    }
+    for input, want := range ints {
+        val, err := evalStr(env, input)
+        if err != nil {
+            t.Fatalf("%q: %v", input, err)
+        }
+        if val.Type != cmd.TYPE_INT64 || val.I64 != want {
+            t.Fatalf("%q: got %+v, want %d", input, val, want)
+        }
+    }
+    val, err := evalStr(env, "s + '-' + 'z'")
+    if err != nil || val.Type != cmd.TYPE_BYTES || string(val.Str) != "xy-z" {
+        t.Fatalf("got %+v, %v", val, err)
+    }
+    // the operands are not modified
+    if string(env.Get("s").Str) != "xy" {
+        t.Fatal("the column is modified")
+    }
+    val, err = evalStr(nil, "-9223372036854775807 - 1")
+    if err != nil || val.I64 != math.MinInt64 {
+        t.Fatalf("got %+v, %v", val, err)
+    }
+}
+
+func TestEvalErrors(t *testing.T) {
+    env := (&cmd.Record{}).AddInt64("a", 7).AddStr("s", []byte("xy"))
+    cases := map[string]string{
+        "a + s": "type error: INT64 + BYTES",
+        "s - 'x'": "type error: BYTES - BYTES",
+        "s * 2": "type error: BYTES * INT64",
+        "-s": "type error: - BYTES",
+        "not s": "type error: NOT BYTES",
+        "a = s": "type error: INT64 = BYTES",
+        "s < 1": "type error: BYTES < INT64",
+        "a and s": "type error: INT64 AND BYTES",
+        "s or 1": "type error: BYTES OR INT64",
+        "a / 0": "division by zero",
+        "a % (a - 7)": "division by zero",
+        "1 + c": "unknown column: c",
+        "(1, 2) = 1": "a tuple is not a value",
+    }
+    for input, want := range cases {
+        _, err := evalStr(env, input)
+        if err == nil || !strings.Contains(err.Error(), want) {
+            t.Fatalf("%q: got %v, want %s", input, err, want)
+        }
+    }
+    // no row for the constant expressions
+    if _, err := evalStr(nil, "a + 1"); err == nil {
+        t.Fatal("column without a row")
+    }
+    if _, err := qlTruth(env, QLNode{Value: cmd.Value{Type: QL_STR}}); err == nil {
+        t.Fatal("BYTES as a condition")
+    }
+}
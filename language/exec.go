@@ -0,0 +1,310 @@
+package parser
+
+import (
+    "fmt"
+
+    "github.com/IAmRiteshKoushik/db-dev/cmd"
+)
+
+// the result of a statement
+type Result struct {
+    Names []string // the output columns of SELECT
+    Rows [][]cmd.Value
+    Affected int // the rows added, updated or deleted
+}
+
+// run a parsed statement in a transaction of its own
+// SELECT runs in a read-only transaction, the others are retried on a
+// conflict, see cmd.DBTX.
+func Exec(db *cmd.DB, stmt interface{}) (Result, error) {
+    if _, ok := stmt.(*QLSelect); ok {
+        tx := db.BeginRead()
+        defer tx.Abort()
+        return ExecTx(tx, stmt)
+    }
+    for {
+        tx := db.Begin()
+        res, err := ExecTx(tx, stmt)
+        if err != nil {
+            tx.Abort()
+            return Result{}, err
+        }
+        err = tx.Commit()
+        if err == nil {
+            return res, nil
+        }
+        if err != cmd.ErrConflict {
+            return Result{}, err
+        }
+    }
+}
+
+// run a parsed statement in the transaction
+func ExecTx(tx *cmd.DBTX, stmt interface{}) (Result, error) {
+    switch stmt := stmt.(type) {
+    case *QLCreateTable:
+        def := stmt.Def
+        return Result{}, tx.TableNew(&def)
+    case *QLSelect:
+        return qlSelect(tx, stmt)
+    case *QLInsert:
+        return qlInsert(tx, stmt)
+    case *QLUpdate:
+        return qlUpdate(tx, stmt)
+    case *QLDelete:
+        return qlDelete(tx, stmt)
+    default:
+        return Result{}, fmt.Errorf("unknown statement: %T", stmt)
+    }
+}
+
+func qlSelect(tx *cmd.DBTX, stmt *QLSelect) (Result, error) {
+    tdef, err := tx.TableDef(stmt.Table)
+    if err != nil {
+        return Result{}, err
+    }
+    res := Result{}
+    for i, node := range stmt.Output {
+        if node.Type == QL_STAR {
+            res.Names = append(res.Names, tdef.Cols...)
+        } else {
+            res.Names = append(res.Names, stmt.Names[i])
+        }
+    }
+    err = qlScan(tx, &stmt.QLScan, func(rec cmd.Record) error {
+        row := []cmd.Value{}
+        for _, node := range stmt.Output {
+            if node.Type == QL_STAR {
+                row = append(row, rec.Vals...)
+                continue
+            }
+            val, err := qlEval(&rec, node)
+            if err != nil {
+                return err
+            }
+            row = append(row, val)
+        }
+        res.Rows = append(res.Rows, row)
+        return nil
+    })
+    if err != nil {
+        return Result{}, err
+    }
+    return res, nil
+}
+
+// the values are constant expressions
+func qlInsert(tx *cmd.DBTX, stmt *QLInsert) (Result, error) {
+    res := Result{}
+    for _, row := range stmt.Values {
+        rec := cmd.Record{}
+        for i, node := range row {
+            val, err := qlEval(nil, node)
+            if err != nil {
+                return Result{}, err
+            }
+            rec.Cols = append(rec.Cols, stmt.Names[i])
+            rec.Vals = append(rec.Vals, val)
+        }
+        updated, err := tx.Set(stmt.Table, rec, stmt.Mode)
+        if err != nil {
+            return Result{}, err
+        }
+        if updated {
+            res.Affected++
+        }
+    }
+    return res, nil
+}
+
+// the new values are evaluated against the old row, the rows are updated
+// after the scan, since the updates would invalidate the scanner
+func qlUpdate(tx *cmd.DBTX, stmt *QLUpdate) (Result, error) {
+    tdef, err := tx.TableDefWrite(stmt.Table)
+    if err != nil {
+        return Result{}, err
+    }
+    cols := []int{}
+    for _, name := range stmt.Names {
+        i := colIndexOf(tdef.Cols, name)
+        switch {
+        case i < 0:
+            return Result{}, fmt.Errorf("table %s: unknown column %s", tdef.Name, name)
+        case i < tdef.PKeys:
+            return Result{}, fmt.Errorf("table %s: cannot update the primary key column %s",
+                tdef.Name, name)
+        }
+        for _, c := range cols {
+            if c == i {
+                return Result{}, fmt.Errorf("table %s: duplicate column %s", tdef.Name, name)
+            }
+        }
+        cols = append(cols, i)
+    }
+
+    updates := []cmd.Record{}
+    err = qlScan(tx, &stmt.QLScan, func(rec cmd.Record) error {
+        vals := append([]cmd.Value{}, rec.Vals...)
+        for i, node := range stmt.Values {
+            val, err := qlEval(&rec, node)
+            if err != nil {
+                return err
+            }
+            vals[cols[i]] = val
+        }
+        updates = append(updates, cmd.Record{Cols: rec.Cols, Vals: vals})
+        return nil
+    })
+    if err != nil {
+        return Result{}, err
+    }
+    res := Result{}
+    for _, rec := range updates {
+        updated, err := tx.Update(stmt.Table, rec)
+        if err != nil {
+            return Result{}, err
+        }
+        if updated {
+            res.Affected++
+        }
+    }
+    return res, nil
+}
+
+// the rows are deleted after the scan, like the above
+func qlDelete(tx *cmd.DBTX, stmt *QLDelete) (Result, error) {
+    tdef, err := tx.TableDefWrite(stmt.Table)
+    if err != nil {
+        return Result{}, err
+    }
+    pkeys := []cmd.Record{}
+    err = qlScan(tx, &stmt.QLScan, func(rec cmd.Record) error {
+        pkeys = append(pkeys, cmd.Record{Cols: rec.Cols[:tdef.PKeys], Vals: rec.Vals[:tdef.PKeys]})
+        return nil
+    })
+    if err != nil {
+        return Result{}, err
+    }
+    res := Result{}
+    for _, rec := range pkeys {
+        deleted, err := tx.Delete(stmt.Table, rec)
+        if err != nil {
+            return Result{}, err
+        }
+        if deleted {
+            res.Affected++
+        }
+    }
+    return res, nil
+}
+
+// call fn for the rows in the INDEX BY range that pass the FILTER, after
+// skipping the offset and up to the limit
+func qlScan(tx *cmd.DBTX, req *QLScan, fn func(rec cmd.Record) error) error {
+    sc := cmd.Scanner{}
+    if err := qlScanInit(req, &sc); err != nil {
+        return err
+    }
+    if err := tx.Scan(req.Table, &sc); err != nil {
+        return err
+    }
+    skip, n := req.Offset, int64(0)
+    for ; sc.Valid() && n < req.Limit; sc.Next() {
+        rec := cmd.Record{}
+        if err := sc.Deref(&rec); err != nil {
+            return err
+        }
+        if req.Filter.Type != QL_UNINIT {
+            ok, err := qlTruth(&rec, req.Filter)
+            if err != nil {
+                return err
+            }
+            if !ok {
+                continue
+            }
+        }
+        if skip > 0 {
+            skip--
+            continue
+        }
+        if err := fn(rec); err != nil {
+            return err
+        }
+        n++
+    }
+    return sc.Err()
+}
+
+// the comparison operators of the scanner
+var qlScanCmps = map[uint32]int{
+    QL_CMP_GE: cmd.CMP_GE,
+    QL_CMP_GT: cmd.CMP_GT,
+    QL_CMP_LT: cmd.CMP_LT,
+    QL_CMP_LE: cmd.CMP_LE,
+}
+
+// turn INDEX BY into the range of the scanner
+// Without INDEX BY, the whole table is scanned by the primary key. An
+// equality is a range of both ends, and a single comparison is a range open
+// at the other end.
+func qlScanInit(req *QLScan, sc *cmd.Scanner) error {
+    sc.Cmp1, sc.Cmp2 = cmd.CMP_GE, cmd.CMP_LE
+    if req.Key1.Type == QL_UNINIT {
+        return nil
+    }
+    op1, key1, err := qlScanKey(req.Key1)
+    if err != nil {
+        return err
+    }
+    if req.Key2.Type == QL_UNINIT {
+        switch {
+        case op1 == QL_CMP_EQ:
+            sc.Key1, sc.Key2 = key1, key1
+        case qlScanCmps[op1] > 0:
+            sc.Cmp1, sc.Key1 = qlScanCmps[op1], key1
+        default:
+            sc.Cmp1, sc.Cmp2, sc.Key1 = qlScanCmps[op1], cmd.CMP_GE, key1
+        }
+        return nil
+    }
+    op2, key2, err := qlScanKey(req.Key2)
+    if err != nil {
+        return err
+    }
+    if op1 == QL_CMP_EQ || op2 == QL_CMP_EQ {
+        return fmt.Errorf("INDEX BY: an equality can't be a part of a range")
+    }
+    sc.Cmp1, sc.Cmp2 = qlScanCmps[op1], qlScanCmps[op2]
+    sc.Key1, sc.Key2 = key1, key2
+    return nil
+}
+
+// a comparison of the columns to the constant values: a > 1, (a, b) = (1, 2)
+func qlScanKey(node QLNode) (uint32, cmd.Record, error) {
+    rec := cmd.Record{}
+    if _, ok := qlScanCmps[node.Type]; !ok && node.Type != QL_CMP_EQ {
+        return 0, rec, fmt.Errorf("INDEX BY: expected a comparison")
+    }
+    cols, vals := []QLNode{node.Kids[0]}, []QLNode{node.Kids[1]}
+    if cols[0].Type == QL_TUP {
+        cols = cols[0].Kids
+    }
+    if vals[0].Type == QL_TUP {
+        vals = vals[0].Kids
+    }
+    if len(cols) != len(vals) {
+        return 0, rec, fmt.Errorf("INDEX BY: %d columns and %d values", len(cols), len(vals))
+    }
+    for i, col := range cols {
+        if col.Type != QL_SYM {
+            return 0, rec, fmt.Errorf("INDEX BY: expected a column on the left")
+        }
+        val, err := qlEval(nil, vals[i])
+        if err != nil {
+            return 0, rec, fmt.Errorf("INDEX BY: %w", err)
+        }
+        rec.Cols = append(rec.Cols, string(col.Str))
+        rec.Vals = append(rec.Vals, val)
+    }
+    return node.Type, rec, nil
+}
@@ -0,0 +1,258 @@
+package parser
+
+import (
+    "fmt"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+
+    "github.com/IAmRiteshKoushik/db-dev/cmd"
+)
+
+func openDB(t *testing.T) *cmd.DB {
+    t.Helper()
+    db := &cmd.DB{Path: filepath.Join(t.TempDir(), "test.db")}
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+func execStr(db *cmd.DB, input string) (Result, error) {
+    stmt, err := Parse([]byte(input))
+    if err != nil {
+        return Result{}, err
+    }
+    return Exec(db, stmt)
+}
+
+func mustExec(t *testing.T, db *cmd.DB, input string) Result {
+    t.Helper()
+    res, err := execStr(db, input)
+    if err != nil {
+        t.Fatalf("%q: %v", input, err)
+    }
+    return res
+}
+
+// the rows as text, one line each
+func rowsStr(res Result) string {
+    lines := []string{}
+    for _, row := range res.Rows {
+        cells := []string{}
+        for _, val := range row {
+            if val.Type == cmd.TYPE_INT64 {
+                cells = append(cells, fmt.Sprint(val.I64))
+            } else {
+                cells = append(cells, string(val.Str))
+            }
+        }
+        lines = append(lines, strings.Join(cells, ","))
+    }
+    return strings.Join(lines, " ")
+}
+
+func TestExec(t *testing.T) {
+    db := openDB(t)
+    defer db.Close()
+    mustExec(t, db, "create table users (name bytes, id int64, age int64, " +
+        "primary key (id), index (name))")
+    res := mustExec(t, db, "insert into users (id, name, age) values " +
+        "(1, 'a', 30), (2, 'b', 20), (3, 'c', 40), (4, 'b', 50), (5, 'e', 10)")
+    if res.Affected != 5 {
+        t.Fatalf("inserted %d", res.Affected)
+    }
+    if res := mustExec(t, db, "insert into users (id, name, age) values (1, 'x', 0)"); res.Affected != 0 {
+        t.Fatal("duplicate inserted")
+    }
+
+    cases := [][2]string{
+        {"select * from users", "1,a,30 2,b,20 3,c,40 4,b,50 5,e,10"},
+        {"select id from users index by id = 3", "3"},
+        {"select id from users index by id > 3", "4 5"},
+        {"select id from users index by id <= 2", "2 1"},
+        {"select id from users index by id > 1 and id < 5", "2 3 4"},
+        {"select id from users index by id < 4 and id >= 2", "3 2"},
+        {"select id, age from users index by name = 'b'", "2,20 4,50"},
+        {"select name, id from users index by name >= 'c'", "c,3 e,5"},
+        {"select id from users filter age >= 30", "1 3 4"},
+        {"select id from users filter age >= 30 and name != 'c'", "1 4"},
+        {"select id from users filter not age < 30 limit 2", "1 3"},
+        {"select id from users limit 1, 2", "2 3"},
+        {"select id from users index by id >= 2 filter age > 10 limit 1, 10", "3 4"},
+        {"select id from users index by (id) = (9)", ""},
+        {"select age > 25, name = 'b' from users index by id < 3", "0,1 1,0"},
+        {"select id * 10 + age, name + '!' from users index by id = 1", "40,a!"},
+        {"select id from users filter age / 10 % 2 = 0 and -age < -15", "2 3"},
+    }
+    for _, c := range cases {
+        if got := rowsStr(mustExec(t, db, c[0])); got != c[1] {
+            t.Fatalf("%q: got %q, want %q", c[0], got, c[1])
+        }
+    }
+    res = mustExec(t, db, "select id AS x, *, age = 30 from users limit 1")
+    if !reflect.DeepEqual(res.Names, []string{"x", "id", "name", "age", "age = 30"}) {
+        t.Fatalf("names %v", res.Names)
+    }
+
+    // update and delete
+    res = mustExec(t, db, "update users set name = 'z', age = id index by name = 'b'")
+    if res.Affected != 2 {
+        t.Fatalf("updated %d", res.Affected)
+    }
+    if got := rowsStr(mustExec(t, db, "select id, age from users index by name = 'z'")); got != "2,2 4,4" {
+        t.Fatalf("got %q", got)
+    }
+    if got := rowsStr(mustExec(t, db, "select id from users index by name = 'b'")); got != "" {
+        t.Fatalf("old index entries: %q", got)
+    }
+    res = mustExec(t, db, "delete from users filter age < 20")
+    if res.Affected != 3 {
+        t.Fatalf("deleted %d", res.Affected)
+    }
+    if got := rowsStr(mustExec(t, db, "select id from users index by name >= ''")); got != "1 3" {
+        t.Fatalf("got %q", got)
+    }
+    res = mustExec(t, db, "upsert into users (id, name, age) values (1, 'a', 31), (6, 'f', 60)")
+    if res.Affected != 2 {
+        t.Fatalf("upserted %d", res.Affected)
+    }
+    if got := rowsStr(mustExec(t, db, "select * from users")); got != "1,a,31 3,c,40 6,f,60" {
+        t.Fatalf("got %q", got)
+    }
+}
+
+func TestExecErrors(t *testing.T) {
+    db := openDB(t)
+    defer db.Close()
+    mustExec(t, db, "create table t (a int64, b bytes, primary key (a))")
+    mustExec(t, db, "insert into t (a, b) values (1, 'x')")
+    cases := []string{
+        "create table t (a int64, primary key (a))",
+        "select a from nope",
+        "select c from t",
+        "select a from t filter b",
+        "select a from t filter a = b",
+        "select a from t index by b = 'x'",
+        "select a from t index by a != 1",
+        "select a from t index by 1 = a",
+        "select a from t index by a = b",
+        "select a from t index by a = 1 and a < 2",
+        "select a from t index by a > 1 and a > 2",
+        "select a from t index by a = 'x'",
+        "insert into t (a, b) values (a, 'x')",
+        "insert into t (a) values (2)",
+        "update t set a = 2",
+        "update t set c = 2",
+        "update t set b = 'y', b = 'z'",
+        "update t set b = 1",
+    }
+    for _, input := range cases {
+        if _, err := execStr(db, input); err == nil {
+            t.Fatalf("%q: no error", input)
+        }
+    }
+    // nothing changed
+    if got := rowsStr(mustExec(t, db, "select * from t")); got != "1,x" {
+        t.Fatalf("got %q", got)
+    }
+}
+
+// the scans to the end of the tree, which has 3 levels
+func TestExecLarge(t *testing.T) {
+    db := openDB(t)
+    defer db.Close()
+    mustExec(t, db, "create table t (id int64, v bytes, tag bytes, primary key (id), index (tag))")
+    tx := db.Begin()
+    for i := 0; i < 100; i++ {
+        rows := []string{}
+        for j := 0; j < 10; j++ {
+            id := i * 10 + j
+            rows = append(rows, fmt.Sprintf("(%d, '%s', 't%04d')", id, strings.Repeat("x", 2000), id))
+        }
+        stmt, err := Parse([]byte("insert into t (id, v, tag) values " + strings.Join(rows, ", ")))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := ExecTx(tx, stmt); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    cases := [][2]string{
+        {"select id from t index by id > 990 limit 50", "991 992 993 994 995 996 997 998 999"},
+        {"select id from t index by id > 990", "991 992 993 994 995 996 997 998 999"},
+        {"select id from t index by id < 3", "2 1 0"},
+        {"select id from t index by tag >= 't0997'", "997 998 999"},
+        {"select id from t index by tag > 't0990' filter id % 2 = 0 limit 3", "992 994 996"},
+    }
+    for _, c := range cases {
+        if got := rowsStr(mustExec(t, db, c[0])); got != c[1] {
+            t.Fatalf("%q: got %q, want %q", c[0], got, c[1])
+        }
+    }
+    if res := mustExec(t, db, "delete from t index by id >= 500"); res.Affected != 500 {
+        t.Fatalf("deleted %d", res.Affected)
+    }
+}
+
+// the internal tables can be read but not written
+func TestExecInternal(t *testing.T) {
+    db := openDB(t)
+    defer db.Close()
+    mustExec(t, db, "create table t (a int64, primary key (a))")
+    cases := []string{
+        "insert into @table (name, def) values ('x', '{}')",
+        "upsert into @table (name, def) values ('t', '{}')",
+        "update @meta set val = 'x'",
+        "update @table set def = '{}' index by name = 't'",
+        "delete from @table",
+        "delete from @meta",
+        "upsert into @meta (key, val) values ('x', 'y')",
+    }
+    for _, input := range cases {
+        if _, err := execStr(db, input); err == nil || !strings.Contains(err.Error(), "read-only") {
+            t.Fatalf("%q: got %v", input, err)
+        }
+    }
+    if got := rowsStr(mustExec(t, db, "select name from @table")); got != "t" {
+        t.Fatalf("got %q", got)
+    }
+    if got := rowsStr(mustExec(t, db, "select key from @meta index by key = 'next_prefix'")); got != "next_prefix" {
+        t.Fatalf("got %q", got)
+    }
+    mustExec(t, db, "create table u (a int64, primary key (a))")
+    mustExec(t, db, "insert into t (a) values (1)")
+}
+
+// the statements run in an explicit transaction
+func TestExecTx(t *testing.T) {
+    db := openDB(t)
+    defer db.Close()
+    mustExec(t, db, "create table t (a int64, b int64, primary key (a))")
+    tx := db.Begin()
+    for _, input := range []string{
+        "insert into t (a, b) values (1, 1), (2, 2)",
+        "update t set b = b = 1 filter a = 2",
+    } {
+        stmt, err := Parse([]byte(input))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := ExecTx(tx, stmt); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if got := rowsStr(mustExec(t, db, "select * from t")); got != "" {
+        t.Fatalf("uncommitted rows: %q", got)
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if got := rowsStr(mustExec(t, db, "select * from t")); got != "1,1 2,0" {
+        t.Fatalf("got %q", got)
+    }
+}
@@ -1,8 +1,48 @@
 package parser
 
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/IAmRiteshKoushik/db-dev/cmd"
+)
+
+// the node types
+// The scalar types are the same as the column types, so a node can be used
+// as a value directly.
+const (
+    QL_UNINIT = 0
+    // scalar
+    QL_STR = cmd.TYPE_BYTES
+    QL_I64 = cmd.TYPE_INT64
+    // binary ops
+    QL_CMP_GE = 10 // >=
+    QL_CMP_GT = 11 // >
+    QL_CMP_LT = 12 // <
+    QL_CMP_LE = 13 // <=
+    QL_CMP_EQ = 14 // =
+    QL_CMP_NE = 15 // !=
+    QL_ADD = 20
+    QL_SUB = 21
+    QL_MUL = 22
+    QL_DIV = 23
+    QL_MOD = 24
+    QL_AND = 30
+    QL_OR = 31
+    // unary ops
+    QL_NOT = 50
+    QL_NEG = 51
+    // others
+    QL_SYM = 100 // column
+    QL_TUP = 101 // tuple
+    QL_STAR = 102 // select *
+    QL_ERR = 200 // error; from INDEX BY or FILTER
+)
+
 // syntax tree
 type QLNode struct {
-    Value // Type I64, Str
+    cmd.Value // Type I64, Str
     Kids []QLNode
 }
 
@@ -12,68 +52,299 @@ type Parser struct {
     err     error
 }
 
+// the first error stops the parser, the offset is where the input didn't
+// match what was expected
+type ParseError struct {
+    Offset int
+    Expected string
+}
+
+func (e *ParseError) Error() string {
+    return fmt.Sprintf("parse error at offset %d: expected %s", e.Offset, e.Expected)
+}
+
+// parse a single statement, the trailing semicolon is optional
+// The result is one of *QLSelect, *QLInsert, *QLUpdate, *QLDelete and
+// *QLCreateTable.
+func Parse(input []byte) (interface{}, error) {
+    p := &Parser{input: input}
+    stmt := pStmt(p)
+    pKeyword(p, ";")
+    skipSpace(p)
+    if p.idx < len(p.input) {
+        pErr(p, nil, "the end of the statement")
+    }
+    if p.err != nil {
+        return nil, p.err
+    }
+    return stmt, nil
+}
+
+// a, b, c
+// A single expression is not a tuple.
 func pExprTuple(p *Parser, node *QLNode) {
     kids := []QLNode{{}}
     pExprOr(p, &kids[len(kids) - 1])
+    for pKeyword(p, ",") {
+        kids = append(kids, QLNode{})
+        pExprOr(p, &kids[len(kids) - 1])
+    }
+    if len(kids) > 1 {
+        node.Type = QL_TUP
+        node.Kids = kids
+    } else {
+        *node = kids[0]
+    }
 }
 
-func pExprOr(p *Parser, node *QLNode){
+// the operators from the lowest precedence to the highest
 
+func pExprOr(p *Parser, node *QLNode){ // a OR b
+    pExprBinop(p, node, []string{"or"}, []uint32{QL_OR}, pExprAnd)
 }
 
-func pExprAnd(p *Parser, node *QLNode){
-
+func pExprAnd(p *Parser, node *QLNode){ // a AND b
+    pExprBinop(p, node, []string{"and"}, []uint32{QL_AND}, pExprNot)
 }
 
 func pExprNot(p *Parser, node *QLNode){ // NOT a
-
-} 
-
-func pExprCmp(p *Parser, node *QLNode){
-
+    if pKeyword(p, "not") {
+        node.Type = QL_NOT
+        node.Kids = []QLNode{{}}
+        pExprNot(p, &node.Kids[0])
+    } else {
+        pExprCmp(p, node)
+    }
 }
 
-func pExprAdd(p *Parser, node *QLNode){
-
+func pExprCmp(p *Parser, node *QLNode){ // a < b
+    // the longer operators are tried first
+    pExprBinop(p, node,
+        []string{"!=", ">=", "<=", "=", ">", "<"},
+        []uint32{QL_CMP_NE, QL_CMP_GE, QL_CMP_LE, QL_CMP_EQ, QL_CMP_GT, QL_CMP_LT},
+        pExprAdd)
 }
 
-func pExprMul(p *Parser, node *QLNode){
-
+func pExprAdd(p *Parser, node *QLNode){ // a + b
+    pExprBinop(p, node, []string{"+", "-"}, []uint32{QL_ADD, QL_SUB}, pExprMul)
 }
 
-func pExprUnop(p *Parser, node *QLNode){
+func pExprMul(p *Parser, node *QLNode){ // a * b
+    pExprBinop(p, node,
+        []string{"*", "/", "%"}, []uint32{QL_MUL, QL_DIV, QL_MOD}, pExprUnop)
+}
 
+func pExprUnop(p *Parser, node *QLNode){ // -a
+    if pKeyword(p, "-") {
+        node.Type = QL_NEG
+        node.Kids = []QLNode{{}}
+        pExprUnop(p, &node.Kids[0])
+    } else {
+        pExprAtom(p, node)
+    }
 }
 
-func pExprBinop(p *Parser, node *QLNode, ops []string, types []uint32, 
+// left associative binary operators of the same precedence
+func pExprBinop(p *Parser, node *QLNode, ops []string, types []uint32,
     next func(*Parser, *QLNode)){
-    
+    if len(ops) != len(types) {
+        panic("pExprBinop: bad operators")
+    }
+    left := QLNode{}
+    next(p, &left)
+    for more := true; more; {
+        more = false
+        for i := range ops {
+            if pKeyword(p, ops[i]) {
+                expr := QLNode{Value: cmd.Value{Type: types[i]}}
+                expr.Kids = []QLNode{left, {}}
+                next(p, &expr.Kids[1])
+                left = expr
+                more = true
+                break
+            }
+        }
+    }
+    *node = left
 }
 
+// match a sequence of keywords or operators, case insensitive
+// Nothing is consumed if they don't all match. A keyword must not be
+// followed by a symbol character, so that `order` doesn't match `or`.
 func pKeyword(p *Parser, kwds ...string) bool {
+    if p.err != nil {
+        return false
+    }
+    save := p.idx
+    for _, kw := range kwds {
+        skipSpace(p)
+        end := p.idx + len(kw)
+        if end > len(p.input) {
+            p.idx = save
+            return false
+        }
+        ok := strings.EqualFold(string(p.input[p.idx:end]), kw)
+        if ok && isSym(kw[len(kw) - 1]) && end < len(p.input) {
+            ok = !isSym(p.input[end])
+        }
+        if !ok {
+            p.idx = save
+            return false
+        }
+        p.idx = end
+    }
+    return true
+}
 
+// the keywords can't be used as names
+// `key` is not one of them, it only follows `primary`, so `@meta` has a
+// `key` column.
+var pKeywordSet = map[string]bool{
+    "from": true, "index": true, "filter": true, "limit": true, "as": true,
+    "and": true, "or": true, "not": true, "by": true, "set": true,
+    "values": true, "select": true, "insert": true, "replace": true,
+    "upsert": true, "update": true, "delete": true, "into": true,
+    "create": true, "table": true, "primary": true,
 }
 
 func pExprAtom(p *Parser, node *QLNode){
-
+    switch {
+    case pKeyword(p, "("):
+        pExprTuple(p, node)
+        pExpect(p, ")")
+    case pSym(p, node):
+    case pNum(p, node):
+    case pStr(p, node):
+    default:
+        pErr(p, node, "a name, a number or a string")
+    }
 }
 
-func pErr(){
-
+// record the first error, the node is marked as an error
+func pErr(p *Parser, node *QLNode, expected string){
+    if node != nil {
+        node.Type = QL_ERR
+    }
+    if p.err != nil {
+        return
+    }
+    skipSpace(p)
+    p.err = &ParseError{Offset: p.idx, Expected: expected}
 }
 
-func pSym(){
+func pExpect(p *Parser, tok string) {
+    if !pKeyword(p, tok) {
+        pErr(p, nil, "`" + tok + "`")
+    }
+}
 
+// a column or a table name
+func pSym(p *Parser, node *QLNode) bool {
+    if p.err != nil {
+        return false
+    }
+    skipSpace(p)
+    end := p.idx
+    if !(end < len(p.input) && isSymStart(p.input[end])) {
+        return false
+    }
+    end++
+    for end < len(p.input) && isSym(p.input[end]) {
+        end++
+    }
+    if pKeywordSet[strings.ToLower(string(p.input[p.idx:end]))] {
+        return false
+    }
+    node.Type = QL_SYM
+    node.Str = p.input[p.idx:end]
+    p.idx = end
+    return true
 }
 
+func pMustSym(p *Parser) string {
+    name := QLNode{}
+    if !pSym(p, &name) {
+        pErr(p, nil, "a name")
+    }
+    return string(name.Str)
+}
 
-func isSum(ch byte) bool {
+// a decimal integer, the sign is a unary operator
+func pNum(p *Parser, node *QLNode) bool {
+    if p.err != nil {
+        return false
+    }
+    skipSpace(p)
+    end := p.idx
+    for end < len(p.input) && isDigit(p.input[end]) {
+        end++
+    }
+    if end == p.idx || (end < len(p.input) && isSym(p.input[end])) {
+        return false
+    }
+    i64, err := strconv.ParseInt(string(p.input[p.idx:end]), 10, 64)
+    if err != nil {
+        pErr(p, node, "a 64-bit integer")
+        return true
+    }
+    node.Type = QL_I64
+    node.I64 = i64
+    p.idx = end
+    return true
+}
 
+// a string in single or double quotes, a backslash escapes the next byte
+func pStr(p *Parser, node *QLNode) bool {
+    if p.err != nil {
+        return false
+    }
+    skipSpace(p)
+    if p.idx >= len(p.input) {
+        return false
+    }
+    quote := p.input[p.idx]
+    if quote != '\'' && quote != '"' {
+        return false
+    }
+    str := []byte{}
+    for i := p.idx + 1; i < len(p.input); i++ {
+        switch ch := p.input[i]; {
+        case ch == quote:
+            node.Type = QL_STR
+            node.Str = str
+            p.idx = i + 1
+            return true
+        case ch == '\\' && i + 1 < len(p.input):
+            i++
+            str = append(str, p.input[i])
+        default:
+            str = append(str, ch)
+        }
+    }
+    p.idx = len(p.input)
+    pErr(p, node, "the closing quote")
+    return true
 }
 
-func isSymStart(ch byte) bool {
+func skipSpace(p *Parser) {
+    for p.idx < len(p.input) && isSpace(p.input[p.idx]) {
+        p.idx++
+    }
+}
 
+func isSpace(ch byte) bool {
+    return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
 }
 
+func isDigit(ch byte) bool {
+    return '0' <= ch && ch <= '9'
+}
 
+func isSym(ch byte) bool {
+    return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ch == '_' || isDigit(ch)
+}
 
+// the internal tables start with @
+func isSymStart(ch byte) bool {
+    return (isSym(ch) && !isDigit(ch)) || ch == '@'
+}
@@ -0,0 +1,215 @@
+package parser
+
+import (
+    "fmt"
+    "math"
+    "reflect"
+    "strings"
+    "testing"
+
+    "github.com/IAmRiteshKoushik/db-dev/cmd"
+)
+
+var nodeStrOps = map[uint32]string{
+    QL_CMP_GE: ">=", QL_CMP_GT: ">", QL_CMP_LT: "<", QL_CMP_LE: "<=",
+    QL_CMP_EQ: "=", QL_CMP_NE: "!=", QL_ADD: "+", QL_SUB: "-", QL_MUL: "*",
+    QL_DIV: "/", QL_MOD: "%", QL_AND: "and", QL_OR: "or", QL_NOT: "not",
+    QL_NEG: "neg", QL_TUP: "tuple",
+}
+
+// the tree as an s-expression
+func nodeStr(node QLNode) string {
+    switch node.Type {
+    case QL_I64:
+        return fmt.Sprint(node.I64)
+    case QL_STR:
+        return fmt.Sprintf("%q", node.Str)
+    case QL_SYM:
+        return string(node.Str)
+    case QL_STAR:
+        return "*"
+    case QL_UNINIT:
+        return "_"
+    case QL_ERR:
+        return "ERR"
+    }
+    kids := []string{nodeStrOps[node.Type]}
+    for _, kid := range node.Kids {
+        kids = append(kids, nodeStr(kid))
+    }
+    return "(" + strings.Join(kids, " ") + ")"
+}
+
+func parseExpr(input string) (QLNode, error) {
+    p := &Parser{input: []byte(input)}
+    node := QLNode{}
+    pExprTuple(p, &node)
+    skipSpace(p)
+    if p.idx < len(p.input) {
+        pErr(p, nil, "the end")
+    }
+    return node, p.err
+}
+
+func TestParseExpr(t *testing.T) {
+    cases := [][2]string{
+        {"a", "a"},
+        {" 12 ", "12"},
+        {`'it\'s'`, `"it's"`},
+        {`"a\"b" `, `"a\"b"`},
+        {"a + b * c - d", "(- (+ a (* b c)) d)"},
+        {"(a + b) * c % 3", "(% (* (+ a b) c) 3)"},
+        {"-a - -1", "(- (neg a) (neg 1))"},
+        {"a >= 1 and b != 'x' or not c = d", `(or (and (>= a 1) (!= b "x")) (not (= c d)))`},
+        {"a<=b AND b<c", "(and (<= a b) (< b c))"},
+        {"not not a", "(not (not a))"},
+        {"(a, b) > (1, 2)", "(> (tuple a b) (tuple 1 2))"},
+        {"a, b + 1", "(tuple a (+ b 1))"},
+        {"ORDER or android", "(or ORDER android)"},
+        {"@table", "@table"},
+        {"key = primary_key", "(= key primary_key)"},
+    }
+    for _, c := range cases {
+        node, err := parseExpr(c[0])
+        if err != nil {
+            t.Fatalf("%q: %v", c[0], err)
+        }
+        if got := nodeStr(node); got != c[1] {
+            t.Fatalf("%q: got %s, want %s", c[0], got, c[1])
+        }
+    }
+}
+
+func TestParseStmt(t *testing.T) {
+    stmt, err := Parse([]byte("select a, b + 1 AS c, *, a*2 from t " +
+        "index by a > 1 and a <= 5 filter b = 'x' limit 10, 20;"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    sel := stmt.(*QLSelect)
+    if sel.Table != "t" || sel.Offset != 10 || sel.Limit != 20 {
+        t.Fatalf("got %+v", sel)
+    }
+    if !reflect.DeepEqual(sel.Names, []string{"a", "c", "*", "a*2"}) {
+        t.Fatalf("names %v", sel.Names)
+    }
+    outputs := []string{}
+    for _, node := range sel.Output {
+        outputs = append(outputs, nodeStr(node))
+    }
+    if got := strings.Join(outputs, " "); got != "a (+ b 1) * (* a 2)" {
+        t.Fatalf("outputs %s", got)
+    }
+    if nodeStr(sel.Key1) != "(> a 1)" || nodeStr(sel.Key2) != "(<= a 5)" ||
+        nodeStr(sel.Filter) != `(= b "x")` {
+        t.Fatalf("got %s %s %s", nodeStr(sel.Key1), nodeStr(sel.Key2), nodeStr(sel.Filter))
+    }
+
+    stmt, err = Parse([]byte("SELECT a FROM t LIMIT 3"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    sel = stmt.(*QLSelect)
+    if sel.Key1.Type != QL_UNINIT || sel.Filter.Type != QL_UNINIT || sel.Offset != 0 || sel.Limit != 3 {
+        t.Fatalf("got %+v", sel)
+    }
+    stmt, _ = Parse([]byte("select a from t"))
+    if sel = stmt.(*QLSelect); sel.Limit != math.MaxInt64 {
+        t.Fatalf("limit %d", sel.Limit)
+    }
+
+    stmt, err = Parse([]byte("create table t (a int64, b bytes, c bytes, " +
+        "primary key (c, a), index (b))"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := cmd.TableDef{
+        Name: "t",
+        Cols: []string{"c", "a", "b"},
+        Types: []uint32{cmd.TYPE_BYTES, cmd.TYPE_INT64, cmd.TYPE_BYTES},
+        PKeys: 2,
+        Indexes: [][]string{{"b"}},
+    }
+    if def := stmt.(*QLCreateTable).Def; !reflect.DeepEqual(def, want) {
+        t.Fatalf("got %+v", def)
+    }
+
+    stmt, err = Parse([]byte("upsert into t (a, b) values (1, 'x'), (-2, 'y' || 'z')"))
+    if err == nil {
+        t.Fatal("bad expression accepted")
+    }
+    stmt, err = Parse([]byte("upsert into t (a, b) values (1, 'x'), (-2, 'y')"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    ins := stmt.(*QLInsert)
+    if ins.Table != "t" || ins.Mode != cmd.MODE_UPSERT || len(ins.Values) != 2 ||
+        nodeStr(ins.Values[1][0]) != "(neg 2)" {
+        t.Fatalf("got %+v", ins)
+    }
+    for input, mode := range map[string]int{
+        "insert into t (a) values (1)": cmd.MODE_INSERT_ONLY,
+        "replace into t (a) values (1)": cmd.MODE_UPDATE_ONLY,
+    } {
+        stmt, err := Parse([]byte(input))
+        if err != nil || stmt.(*QLInsert).Mode != mode {
+            t.Fatalf("%q: %v", input, err)
+        }
+    }
+
+    stmt, err = Parse([]byte("update t set a = a + 1, b = 'x' index by a = 1 filter b != ''"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    upd := stmt.(*QLUpdate)
+    if !reflect.DeepEqual(upd.Names, []string{"a", "b"}) || nodeStr(upd.Values[0]) != "(+ a 1)" ||
+        nodeStr(upd.Key1) != "(= a 1)" || nodeStr(upd.Filter) != `(!= b "")` {
+        t.Fatalf("got %+v", upd)
+    }
+
+    stmt, err = Parse([]byte("delete from t filter a < 0 limit 1"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if del := stmt.(*QLDelete); del.Table != "t" || nodeStr(del.Filter) != "(< a 0)" || del.Limit != 1 {
+        t.Fatalf("got %+v", del)
+    }
+}
+
+func TestParseErrors(t *testing.T) {
+    cases := []struct {
+        input string
+        offset int
+        expected string
+    }{
+        {"", 0, "a statement"},
+        {"drop table t", 0, "a statement"},
+        {"select a t", 9, "`from`"},
+        {"select from t", 7, "a name, a number or a string"},
+        {"select a from", 13, "a name"},
+        {"select a from t limit x", 22, "a number"},
+        {"select a from t; x", 17, "the end of the statement"},
+        {"select (a + 1 from t", 14, "`)`"},
+        {"select 'abc from t", 18, "the closing quote"},
+        {"select 99999999999999999999 from t", 7, "a 64-bit integer"},
+        {"insert into t (a, b) values (1)", 30, "`,`"},
+        {"insert into t (a) values (1", 27, "`)`"},
+        {"update t set a 1", 15, "`=`"},
+        {"create table t (a int64, b text)", 27, "a column type: `INT64` or `BYTES`"},
+        {"create table t (a int64)", 24, "`PRIMARY KEY`"},
+        {"create table t (a int64, primary key (b))", 41, "a table column in `PRIMARY KEY`, got b"},
+        {"select select from t", 7, "a name, a number or a string"},
+        {"select a from t index by a > 1 AND a < 5 AND a = 3", 41, "at most 2 comparisons in `INDEX BY`"},
+        {"select key from t index by a > 1 and", 36, "a name, a number or a string"},
+    }
+    for _, c := range cases {
+        _, err := Parse([]byte(c.input))
+        perr, ok := err.(*ParseError)
+        if !ok {
+            t.Fatalf("%q: got %v", c.input, err)
+        }
+        if perr.Offset != c.offset || perr.Expected != c.expected {
+            t.Fatalf("%q: got %v, want offset %d and %s", c.input, err, c.offset, c.expected)
+        }
+    }
+}
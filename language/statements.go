@@ -1,6 +1,8 @@
 package parser
 
 import(
+    "math"
+
     "github.com/IAmRiteshKoushik/db-dev/cmd"
 )
 
@@ -14,7 +16,7 @@ type QLScan struct{
     Filter QLNode // boolean, optional
     // LIMIT x, y
     Offset int64
-    Limit  int64
+    Limit  int64 // math.MaxInt64 without a limit
 }
 
 // stmt: select
@@ -66,7 +68,229 @@ func pStmt(p *Parser) interface{} {
     case pKeyword(p, "update"):
         return pUpdate(p)
     default:
-        pErr(p, nil, "unknown stmt")
+        pErr(p, nil, "a statement")
+        return nil
+    }
+}
+
+// CREATE TABLE t (a INT64, b BYTES, PRIMARY KEY (b), INDEX (a, b))
+// The primary key columns are moved to the front, see cmd.TableDef.
+func pCreateTable(p *Parser) *QLCreateTable {
+    stmt := QLCreateTable{}
+    stmt.Def.Name = pMustSym(p)
+    pExpect(p, "(")
+    pkeys := []string(nil)
+    for more := true; more && p.err == nil; more = pKeyword(p, ",") {
+        switch {
+        case pKeyword(p, "primary", "key"):
+            if pkeys != nil {
+                pErr(p, nil, "a single `PRIMARY KEY`")
+            }
+            pkeys = pNameList(p)
+        case pKeyword(p, "index"):
+            stmt.Def.Indexes = append(stmt.Def.Indexes, pNameList(p))
+        default:
+            stmt.Def.Cols = append(stmt.Def.Cols, pMustSym(p))
+            stmt.Def.Types = append(stmt.Def.Types, pType(p))
+        }
+    }
+    pExpect(p, ")")
+    if p.err == nil && pkeys == nil {
+        pErr(p, nil, "`PRIMARY KEY`")
+    }
+    if p.err != nil {
+        return nil
+    }
+    // reorder the columns
+    def := &stmt.Def
+    cols, types := []string{}, []uint32{}
+    for _, key := range pkeys {
+        i := colIndexOf(def.Cols, key)
+        if i < 0 {
+            pErr(p, nil, "a table column in `PRIMARY KEY`, got " + key)
+            return nil
+        }
+        cols, types = append(cols, def.Cols[i]), append(types, def.Types[i])
+        def.Cols[i] = "" // taken
+    }
+    for i, col := range def.Cols {
+        if col != "" {
+            cols, types = append(cols, col), append(types, def.Types[i])
+        }
+    }
+    def.Cols, def.Types, def.PKeys = cols, types, len(pkeys)
+    return &stmt
+}
+
+// the column type
+func pType(p *Parser) uint32 {
+    switch {
+    case pKeyword(p, "int64"):
+        return cmd.TYPE_INT64
+    case pKeyword(p, "bytes"):
+        return cmd.TYPE_BYTES
+    default:
+        pErr(p, nil, "a column type: `INT64` or `BYTES`")
+        return cmd.TYPE_ERROR
+    }
+}
+
+// (a, b, c)
+func pNameList(p *Parser) []string {
+    pExpect(p, "(")
+    names := []string{pMustSym(p)}
+    for pKeyword(p, ",") {
+        names = append(names, pMustSym(p))
+    }
+    pExpect(p, ")")
+    return names
+}
+
+func colIndexOf(cols []string, col string) int {
+    for i, c := range cols {
+        if c == col {
+            return i
+        }
+    }
+    return -1
+}
+
+// SELECT expr AS name, ... FROM t INDEX BY ... FILTER ... LIMIT ...
+func pSelect(p *Parser) *QLSelect {
+    stmt := QLSelect{}
+    pSelectExpr(p, &stmt)
+    for pKeyword(p, ",") {
+        pSelectExpr(p, &stmt)
+    }
+    pExpect(p, "from")
+    stmt.Table = pMustSym(p)
+    pScan(p, &stmt.QLScan)
+    if p.err != nil {
+        return nil
+    }
+    return &stmt
+}
+
+// an output column, the name defaults to the expression for a column
+func pSelectExpr(p *Parser, stmt *QLSelect) {
+    if pKeyword(p, "*") {
+        stmt.Names = append(stmt.Names, "*")
+        stmt.Output = append(stmt.Output, QLNode{Value: cmd.Value{Type: QL_STAR}})
+        return
+    }
+    start := p.idx
+    expr := QLNode{}
+    pExprOr(p, &expr)
+    name := ""
+    if pKeyword(p, "as") {
+        name = pMustSym(p)
+    } else if expr.Type == QL_SYM {
+        name = string(expr.Str)
+    } else {
+        name = string(trimSpace(p.input[start:p.idx]))
+    }
+    stmt.Names = append(stmt.Names, name)
+    stmt.Output = append(stmt.Output, expr)
+}
+
+func trimSpace(s []byte) []byte {
+    for len(s) > 0 && isSpace(s[0]) {
+        s = s[1:]
+    }
+    for len(s) > 0 && isSpace(s[len(s) - 1]) {
+        s = s[:len(s) - 1]
+    }
+    return s
+}
+
+// INDEX BY a > 1 AND a < 5 FILTER expr LIMIT offset, count
+// The INDEX BY is a comparison, or two of them for a range.
+func pScan(p *Parser, scan *QLScan) {
+    if pKeyword(p, "index", "by") {
+        // not pExprAnd, which would take a 3rd one as a part of the 1st
+        pExprNot(p, &scan.Key1)
+        if pKeyword(p, "and") {
+            pExprNot(p, &scan.Key2)
+        }
+        save := p.idx
+        if pKeyword(p, "and") {
+            p.idx = save
+            pErr(p, nil, "at most 2 comparisons in `INDEX BY`")
+        }
+    }
+    if pKeyword(p, "filter") {
+        pExprOr(p, &scan.Filter)
+    }
+    scan.Offset, scan.Limit = 0, math.MaxInt64
+    if pKeyword(p, "limit") {
+        n := pCount(p)
+        if pKeyword(p, ",") {
+            scan.Offset, scan.Limit = n, pCount(p)
+        } else {
+            scan.Limit = n
+        }
+    }
+}
+
+// a non-negative number
+func pCount(p *Parser) int64 {
+    node := QLNode{}
+    if !pNum(p, &node) {
+        pErr(p, nil, "a number")
+    }
+    return node.I64
+}
+
+// INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')
+func pInsert(p *Parser, mode int) *QLInsert {
+    stmt := QLInsert{Mode: mode}
+    stmt.Table = pMustSym(p)
+    stmt.Names = pNameList(p)
+    pExpect(p, "values")
+    for more := true; more && p.err == nil; more = pKeyword(p, ",") {
+        pExpect(p, "(")
+        row := []QLNode{}
+        for i := range stmt.Names {
+            if i > 0 {
+                pExpect(p, ",")
+            }
+            row = append(row, QLNode{})
+            pExprOr(p, &row[i])
+        }
+        pExpect(p, ")")
+        stmt.Values = append(stmt.Values, row)
+    }
+    if p.err != nil {
+        return nil
+    }
+    return &stmt
+}
+
+// DELETE FROM t INDEX BY ... FILTER ... LIMIT ...
+func pDelete(p *Parser) *QLDelete {
+    stmt := QLDelete{}
+    stmt.Table = pMustSym(p)
+    pScan(p, &stmt.QLScan)
+    if p.err != nil {
+        return nil
+    }
+    return &stmt
+}
+
+// UPDATE t SET a = expr, ... INDEX BY ... FILTER ... LIMIT ...
+func pUpdate(p *Parser) *QLUpdate {
+    stmt := QLUpdate{}
+    stmt.Table = pMustSym(p)
+    pExpect(p, "set")
+    for more := true; more && p.err == nil; more = pKeyword(p, ",") {
+        stmt.Names = append(stmt.Names, pMustSym(p))
+        pExpect(p, "=")
+        stmt.Values = append(stmt.Values, QLNode{})
+        pExprOr(p, &stmt.Values[len(stmt.Values) - 1])
+    }
+    pScan(p, &stmt.QLScan)
+    if p.err != nil {
         return nil
     }
+    return &stmt
 }
@@ -2,29 +2,32 @@ package main
 
 import (
 	"fmt"
-
-	misc "github.com/IAmRiteshKoushik/db-dev/misc"
+	"os"
 )
 
-const(
-    DATA_STORE_PATH = "/home/rk/mydb/"
-)
+const usage = `usage:
+    db-dev shell <dbfile>    run statements interactively
+    db-dev serve [--addr host:port] <dbfile>
+                             serve the database over TCP
+`
 
 func main(){
-    path := DATA_STORE_PATH + "file2.txt"
-    data := "Hello, World"
-    // if err := misc.SaveData1(path, []byte(data)); err != nil {
-    //     fmt.Println("Data not saved")
-    //     fmt.Println(err)
-    //     return
-    // }
-    // fmt.Println("Data added to file")
-
-    if err := misc.SaveData2(path, []byte(data)); err != nil {
-        fmt.Println("Data not saved")
-        fmt.Println(err)
-        return
+    if len(os.Args) < 2 {
+        fmt.Fprint(os.Stderr, usage)
+        os.Exit(2)
+    }
+    var err error
+    switch os.Args[1] {
+    case "shell":
+        err = shellMain(os.Args[2:])
+    case "serve":
+        err = serveMain(os.Args[2:])
+    default:
+        fmt.Fprint(os.Stderr, usage)
+        os.Exit(2)
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "db-dev:", err)
+        os.Exit(1)
     }
-    fmt.Println("Data added to file")
-    return
 }
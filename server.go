@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/IAmRiteshKoushik/db-dev/cmd"
+	parser "github.com/IAmRiteshKoushik/db-dev/language"
+)
+
+// The server protocol
+// The client sends one statement per line, the trailing semicolon is
+// optional. Each connection is a session with its own transaction, the
+// statements run in it and their updates are only visible to the session
+// until COMMIT. ABORT (or ROLLBACK) throws them away. The transaction begins
+// with the first statement after that, so an idle session doesn't hold an
+// old snapshot. Closing the connection aborts the transaction.
+// A failed statement aborts the transaction, except for a parse error. The
+// session then rejects the statements until ROLLBACK (or ABORT), so that a
+// client that missed the error can't commit the rest of the transaction.
+// A COMMIT of an aborted transaction fails and ends it. A COMMIT can also
+// fail with a conflict with another session, the client should run the
+// transaction again.
+//
+// The server replies to each line with a sequence of frames, a frame is a
+// 4-byte big-endian length followed by a JSON object:
+//   {"names": ["a", "b"]}          the columns, SELECT only
+//   {"row": [1, "x"]}              a row, SELECT only
+//   {"ok": true, "affected": 0}    the last frame on success
+//   {"error": "..."}               the last frame on failure
+// INT64 is a JSON number. BYTES is a JSON string of the value in base64
+// (the standard encoding with padding), since the value can be any bytes
+// and JSON strings are UTF-8.
+
+// the longest line accepted from a client
+const SERVER_MAX_LINE = 1 << 20
+
+// db-dev serve [--addr host:port] <dbfile>
+func serveMain(args []string) error {
+    flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+    addr := flags.String("addr", "127.0.0.1:7070", "the address to listen on")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if flags.NArg() != 1 {
+        return fmt.Errorf("serve: expected a database file")
+    }
+    db := &cmd.DB{Path: flags.Arg(0)}
+    if err := db.Open(); err != nil {
+        return err
+    }
+    defer db.Close()
+    ln, err := net.Listen("tcp", *addr)
+    if err != nil {
+        return err
+    }
+    fmt.Fprintln(os.Stderr, "db-dev: listening on", ln.Addr())
+
+    // stop accepting on a signal, then end the sessions
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-sigs
+        ln.Close()
+    }()
+    srv := newServer(db)
+    err = srv.serve(ln)
+    srv.shutdown()
+    return err
+}
+
+type server struct {
+    db *cmd.DB
+    mu sync.Mutex // protects conns
+    conns map[net.Conn]bool
+    wg sync.WaitGroup // the running sessions
+}
+
+func newServer(db *cmd.DB) *server {
+    return &server{db: db, conns: map[net.Conn]bool{}}
+}
+
+// accept the connections until the listener is closed
+func (srv *server) serve(ln net.Listener) error {
+    for {
+        conn, err := ln.Accept()
+        if errors.Is(err, net.ErrClosed) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        srv.mu.Lock()
+        srv.conns[conn] = true
+        srv.mu.Unlock()
+        srv.wg.Add(1)
+        go func() {
+            defer srv.wg.Done()
+            serveConn(srv.db, conn)
+            srv.mu.Lock()
+            delete(srv.conns, conn)
+            srv.mu.Unlock()
+        }()
+    }
+}
+
+// close the connections and wait for the sessions to abort
+func (srv *server) shutdown() {
+    srv.mu.Lock()
+    for conn := range srv.conns {
+        conn.Close()
+    }
+    srv.mu.Unlock()
+    srv.wg.Wait()
+}
+
+// a client connection
+type session struct {
+    db *cmd.DB
+    tx *cmd.DBTX // nil between the transactions
+    aborted bool // a statement failed, waiting for ROLLBACK
+    w *bufio.Writer
+}
+
+func serveConn(db *cmd.DB, conn net.Conn) {
+    defer conn.Close()
+    s := &session{db: db, w: bufio.NewWriter(conn)}
+    defer sessionAbort(s)
+    lines := bufio.NewScanner(conn)
+    lines.Buffer(make([]byte, 4096), SERVER_MAX_LINE)
+    for lines.Scan() {
+        line := strings.TrimSpace(lines.Text())
+        if line == "" {
+            continue
+        }
+        err := sessionRun(s, line)
+        if err == nil {
+            err = s.w.Flush()
+        }
+        if err != nil {
+            return // the connection is broken
+        }
+    }
+    if errors.Is(lines.Err(), bufio.ErrTooLong) {
+        writeFrame(s.w, map[string]interface{}{"error": "the line is too long"})
+        s.w.Flush()
+    }
+}
+
+// run a line and write the reply, returns the write error
+func sessionRun(s *session, line string) error {
+    cmdName := strings.ToLower(strings.TrimSpace(strings.TrimSuffix(line, ";")))
+    switch cmdName {
+    case "commit":
+        var err error
+        if s.aborted {
+            err = errors.New("the transaction was aborted, nothing is committed")
+            s.aborted = false
+        } else if s.tx != nil {
+            err = s.tx.Commit()
+            s.tx = nil
+        }
+        return writeEnd(s.w, 0, err)
+    case "abort", "rollback":
+        sessionAbort(s)
+        s.aborted = false
+        return writeEnd(s.w, 0, nil)
+    }
+    if s.aborted {
+        return writeEnd(s.w, 0, errors.New("the transaction is aborted, ROLLBACK to end it"))
+    }
+
+    stmt, err := parser.Parse([]byte(line))
+    if err != nil {
+        return writeEnd(s.w, 0, err)
+    }
+    if s.tx == nil {
+        s.tx = s.db.Begin()
+    }
+    res, err := parser.ExecTx(s.tx, stmt)
+    if err != nil {
+        // the statement might be half done
+        sessionAbort(s)
+        s.aborted = true
+        return writeEnd(s.w, 0, fmt.Errorf("%w (the transaction is aborted)", err))
+    }
+    if _, ok := stmt.(*parser.QLSelect); ok {
+        if err := writeFrame(s.w, map[string]interface{}{"names": res.Names}); err != nil {
+            return err
+        }
+        for _, row := range res.Rows {
+            cells := []interface{}{}
+            for _, val := range row {
+                if val.Type == cmd.TYPE_INT64 {
+                    cells = append(cells, val.I64)
+                } else {
+                    cells = append(cells, val.Str) // base64
+                }
+            }
+            if err := writeFrame(s.w, map[string]interface{}{"row": cells}); err != nil {
+                return err
+            }
+        }
+    }
+    return writeEnd(s.w, res.Affected, nil)
+}
+
+func sessionAbort(s *session) {
+    if s.tx != nil {
+        s.tx.Abort()
+        s.tx = nil
+    }
+}
+
+// the last frame of a reply
+func writeEnd(w io.Writer, affected int, err error) error {
+    if err != nil {
+        return writeFrame(w, map[string]interface{}{"error": err.Error()})
+    }
+    return writeFrame(w, map[string]interface{}{"ok": true, "affected": affected})
+}
+
+// | length | JSON |
+func writeFrame(w io.Writer, msg interface{}) error {
+    data, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    var size [4]byte
+    binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+    if _, err := w.Write(size[:]); err != nil {
+        return err
+    }
+    _, err = w.Write(data)
+    return err
+}
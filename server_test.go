@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IAmRiteshKoushik/db-dev/cmd"
+)
+
+// read a frame
+func readFrame(r io.Reader, msg interface{}) error {
+    var size [4]byte
+    if _, err := io.ReadFull(r, size[:]); err != nil {
+        return err
+    }
+    data := make([]byte, binary.BigEndian.Uint32(size[:]))
+    if _, err := io.ReadFull(r, data); err != nil {
+        return err
+    }
+    return json.Unmarshal(data, msg)
+}
+
+type testClient struct {
+    conn net.Conn
+    r *bufio.Reader
+}
+
+// the reply to a line: the rows as text, or the error
+func (c *testClient) run(t *testing.T, line string) (string, string) {
+    t.Helper()
+    if _, err := fmt.Fprintln(c.conn, line); err != nil {
+        t.Fatal(err)
+    }
+    rows := []string{}
+    for {
+        msg := struct {
+            Names []string
+            Row []interface{}
+            OK bool
+            Affected int
+            Error string
+        }{}
+        if err := readFrame(c.r, &msg); err != nil {
+            t.Fatalf("%q: %v", line, err)
+        }
+        switch {
+        case msg.Error != "":
+            return "", msg.Error
+        case msg.OK:
+            if len(rows) == 0 {
+                return fmt.Sprint(msg.Affected), ""
+            }
+            return strings.Join(rows, " "), ""
+        case msg.Names != nil:
+            rows = append(rows, strings.Join(msg.Names, ","))
+        default:
+            cells := []string{}
+            for _, cell := range msg.Row {
+                if str, ok := cell.(string); ok {
+                    // BYTES in base64
+                    data, err := base64.StdEncoding.DecodeString(str)
+                    if err != nil {
+                        t.Fatalf("%q: %v", line, err)
+                    }
+                    cell = string(data)
+                }
+                cells = append(cells, fmt.Sprint(cell))
+            }
+            rows = append(rows, strings.Join(cells, " "))
+        }
+    }
+}
+
+func TestServer(t *testing.T) {
+    db := &cmd.DB{Path: filepath.Join(t.TempDir(), "test.db")}
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := newServer(db)
+    done := make(chan error, 1)
+    go func() {
+        done <- srv.serve(ln)
+    }()
+    connect := func() *testClient {
+        conn, err := net.Dial("tcp", ln.Addr().String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        return &testClient{conn: conn, r: bufio.NewReader(conn)}
+    }
+    expect := func(c *testClient, line string, want string) {
+        t.Helper()
+        got, errMsg := c.run(t, line)
+        if errMsg != "" || got != want {
+            t.Fatalf("%q: got %q, %q, want %q", line, got, errMsg, want)
+        }
+    }
+    expectErr := func(c *testClient, line string, want string) {
+        t.Helper()
+        if _, errMsg := c.run(t, line); !strings.Contains(errMsg, want) {
+            t.Fatalf("%q: got error %q, want %q", line, errMsg, want)
+        }
+    }
+
+    c1, c2 := connect(), connect()
+    expect(c1, "create table t (a int64, b bytes, primary key (a));", "0")
+    expect(c1, "insert into t (a, b) values (1, 'x'), (2, 'y')", "2")
+    expect(c1, "select * from t", "a,b 1 x 2 y")
+    // not committed yet
+    expectErr(c2, "select * from t", "table not found")
+    expect(c2, "abort", "0")
+    expect(c1, "COMMIT", "0")
+    expect(c2, "select b, a + 1 from t index by a = 2", "b,a + 1 y 3")
+    expect(c2, "commit", "0")
+
+    // abort
+    expect(c1, "delete from t filter a = 1", "1")
+    expect(c1, "rollback;", "0")
+    expect(c1, "select a from t", "a 1 2")
+    expect(c1, "commit", "0")
+
+    // a parse error keeps the transaction, an execution error aborts it
+    expect(c1, "update t set b = 'z' index by a = 1", "1")
+    expectErr(c1, "select a from", "parse error at offset 13")
+    expect(c1, "select b from t index by a = 1", "b z")
+    expectErr(c1, "select c from t", "the transaction is aborted")
+    // the statements are rejected until ROLLBACK
+    expectErr(c1, "select b from t index by a = 1", "the transaction is aborted")
+    expectErr(c1, "insert into t (a, b) values (5, 'x')", "the transaction is aborted")
+    expectErr(c1, "select a from", "the transaction is aborted")
+    expect(c1, "rollback", "0")
+    expect(c1, "select b from t index by a = 1", "b x")
+    expect(c1, "commit", "0")
+    // a COMMIT reports the abort and ends the transaction
+    expect(c1, "update t set b = 'z' index by a = 1", "1")
+    expectErr(c1, "update t set c = 1", "the transaction is aborted")
+    expectErr(c1, "insert into t (a, b) values (5, 'x')", "the transaction is aborted")
+    expectErr(c1, "commit", "the transaction was aborted")
+    expect(c1, "select * from t", "a,b 1 x 2 y")
+    expect(c1, "commit", "0")
+
+    // a conflict between the sessions
+    expect(c1, "update t set b = 'c1' index by a = 1", "1")
+    expect(c2, "update t set b = 'c2' index by a = 1", "1")
+    expect(c2, "commit", "0")
+    expectErr(c1, "commit", "conflict")
+    expect(c1, "select b from t", "b c2 y")
+
+    // BYTES can be any bytes
+    expect(c2, "insert into t (a, b) values (4, '\xff\xfe\x00')", "1")
+    expect(c2, "select b from t index by a = 4", "b \xff\xfe\x00")
+    expect(c2, "abort", "0")
+
+    // the uncommitted updates are lost with the connection
+    expect(c2, "insert into t (a, b) values (3, 'z')", "1")
+    c2.conn.Close()
+    expect(c1, "commit", "0")
+
+    ln.Close()
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    srv.shutdown()
+    if _, err := c1.r.ReadByte(); err != io.EOF {
+        t.Fatalf("the connection is not closed: %v", err)
+    }
+    rec := (&cmd.Record{}).AddInt64("a", 3)
+    if ok, err := db.Get("t", rec); err != nil || ok {
+        t.Fatalf("got the aborted row: %v, %v", ok, err)
+    }
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/term"
+
+	"github.com/IAmRiteshKoushik/db-dev/cmd"
+	parser "github.com/IAmRiteshKoushik/db-dev/language"
+)
+
+// db-dev shell <dbfile>
+func shellMain(args []string) error {
+    if len(args) != 1 {
+        return fmt.Errorf("shell: expected a database file")
+    }
+    db := &cmd.DB{Path: args[0]}
+    if err := db.Open(); err != nil {
+        return err
+    }
+    defer db.Close()
+    // a line editor on the terminal, no prompts when the input is piped
+    fd := int(os.Stdin.Fd())
+    if !term.IsTerminal(fd) {
+        return shellRun(db, newScanInput(os.Stdin, nil), os.Stdout)
+    }
+    state, err := term.MakeRaw(fd)
+    if err != nil {
+        return shellRun(db, newScanInput(os.Stdin, os.Stdout), os.Stdout)
+    }
+    defer term.Restore(fd, state)
+    t := term.NewTerminal(struct {
+        io.Reader
+        io.Writer
+    }{os.Stdin, os.Stdout}, "")
+    return shellRun(db, &termInput{t: t}, t)
+}
+
+// the longest line read from the input
+const SHELL_MAX_LINE = 1 << 24
+
+// the lines of the shell
+type shellInput interface {
+    // returns io.EOF at the end of the input
+    readLine(prompt string) (string, error)
+}
+
+// the line editor, with the history of the lines
+// The terminal is in raw mode, the output goes through the Terminal too.
+type termInput struct {
+    t *term.Terminal
+}
+
+func (in *termInput) readLine(prompt string) (string, error) {
+    in.t.SetPrompt(prompt)
+    line, err := in.t.ReadLine()
+    if err == term.ErrPasteIndicator {
+        err = nil // the pasted line is a line as well
+    }
+    if err == io.EOF {
+        // ^D or ^C, the Terminal redraws the prompt after a write
+        in.t.SetPrompt("")
+        fmt.Fprintln(in.t)
+    }
+    return line, err
+}
+
+// the lines from a reader, the prompts are only written to a terminal
+type scanInput struct {
+    lines *bufio.Scanner
+    prompt io.Writer // nil for no prompts
+}
+
+func newScanInput(r io.Reader, prompt io.Writer) *scanInput {
+    lines := bufio.NewScanner(r)
+    lines.Buffer(make([]byte, 4096), SHELL_MAX_LINE)
+    return &scanInput{lines: lines, prompt: prompt}
+}
+
+func (in *scanInput) readLine(prompt string) (string, error) {
+    if in.prompt != nil {
+        fmt.Fprint(in.prompt, prompt)
+    }
+    if in.lines.Scan() {
+        return in.lines.Text(), nil
+    }
+    if in.prompt != nil {
+        fmt.Fprintln(in.prompt)
+    }
+    if err := in.lines.Err(); err != nil {
+        return "", err
+    }
+    return "", io.EOF
+}
+
+const shellHelp = `statements end with a semicolon and can span lines
+.tables         list the tables
+.schema <t>     show the definition of a table
+.help           show this message
+.quit           exit
+`
+
+// read and run the statements line by line
+// A line starting with a dot is a meta-command, unless it continues a
+// statement. The errors are printed and the shell goes on.
+func shellRun(db *cmd.DB, in shellInput, out io.Writer) error {
+    stmt := ""
+    for {
+        prompt := "db> "
+        if stmt != "" {
+            prompt = "... "
+        }
+        line, err := in.readLine(prompt)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return err
+        }
+        if stmt == "" && strings.HasPrefix(strings.TrimSpace(line), ".") {
+            quit, err := shellMeta(db, strings.Fields(line), out)
+            if err != nil {
+                fmt.Fprintln(out, "error:", err)
+            }
+            if quit {
+                return nil
+            }
+            continue
+        }
+        if stmt == "" && strings.TrimSpace(line) == "" {
+            continue
+        }
+        stmt += line + "\n"
+        if !strings.HasSuffix(strings.TrimSpace(stmt), ";") {
+            continue
+        }
+        if err := shellExec(db, stmt, out); err != nil {
+            fmt.Fprintln(out, "error:", err)
+        }
+        stmt = ""
+    }
+    if strings.TrimSpace(stmt) != "" {
+        fmt.Fprintln(out, "error: incomplete statement at the end of the input")
+    }
+    return nil
+}
+
+// returns whether to quit
+func shellMeta(db *cmd.DB, args []string, out io.Writer) (bool, error) {
+    switch args[0] {
+    case ".quit", ".exit":
+        return true, nil
+    case ".help":
+        fmt.Fprint(out, shellHelp)
+        return false, nil
+    case ".tables":
+        stmt, err := parser.Parse([]byte("select name from @table"))
+        if err != nil {
+            return false, err
+        }
+        res, err := parser.Exec(db, stmt)
+        if err != nil {
+            return false, err
+        }
+        for _, row := range res.Rows {
+            fmt.Fprintln(out, string(row[0].Str))
+        }
+        return false, nil
+    case ".schema":
+        if len(args) != 2 {
+            return false, fmt.Errorf(".schema: expected a table name")
+        }
+        tx := db.BeginRead()
+        defer tx.Abort()
+        tdef, err := tx.TableDef(args[1])
+        if err != nil {
+            return false, err
+        }
+        fmt.Fprintln(out, schemaStr(tdef))
+        return false, nil
+    default:
+        return false, fmt.Errorf("unknown command %s, see .help", args[0])
+    }
+}
+
+// the table definition as a CREATE TABLE statement
+func schemaStr(tdef *cmd.TableDef) string {
+    items := []string{}
+    for i, col := range tdef.Cols {
+        typ := "BYTES"
+        if tdef.Types[i] == cmd.TYPE_INT64 {
+            typ = "INT64"
+        }
+        items = append(items, col + " " + typ)
+    }
+    items = append(items, "PRIMARY KEY (" + strings.Join(tdef.Cols[:tdef.PKeys], ", ") + ")")
+    for _, index := range tdef.Indexes {
+        items = append(items, "INDEX (" + strings.Join(index, ", ") + ")")
+    }
+    return fmt.Sprintf("CREATE TABLE %s (\n    %s\n);", tdef.Name, strings.Join(items, ",\n    "))
+}
+
+func shellExec(db *cmd.DB, input string, out io.Writer) error {
+    stmt, err := parser.Parse([]byte(input))
+    if err != nil {
+        return err
+    }
+    res, err := parser.Exec(db, stmt)
+    if err != nil {
+        return err
+    }
+    switch stmt.(type) {
+    case *parser.QLSelect:
+        printRows(res, out)
+        if len(res.Rows) == 1 {
+            fmt.Fprintln(out, "(1 row)")
+        } else {
+            fmt.Fprintf(out, "(%d rows)\n", len(res.Rows))
+        }
+    case *parser.QLCreateTable:
+        fmt.Fprintln(out, "OK")
+    default:
+        fmt.Fprintf(out, "%d rows affected\n", res.Affected)
+    }
+    return nil
+}
+
+// the rows as an aligned table with a header
+func printRows(res parser.Result, out io.Writer) {
+    w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, strings.Join(res.Names, "\t"))
+    dashes := []string{}
+    for _, name := range res.Names {
+        dashes = append(dashes, strings.Repeat("-", len(name)))
+    }
+    fmt.Fprintln(w, strings.Join(dashes, "\t"))
+    for _, row := range res.Rows {
+        cells := []string{}
+        for _, val := range row {
+            cells = append(cells, valueStr(val))
+        }
+        fmt.Fprintln(w, strings.Join(cells, "\t"))
+    }
+    w.Flush()
+}
+
+// a cell for the output, the strings that can't be printed as is are quoted
+func valueStr(val cmd.Value) string {
+    if val.Type == cmd.TYPE_INT64 {
+        return strconv.FormatInt(val.I64, 10)
+    }
+    str := string(val.Str)
+    if quoted := strconv.Quote(str); quoted[1:len(quoted) - 1] != str {
+        return quoted
+    }
+    return str
+}
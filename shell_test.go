@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/term"
+
+	"github.com/IAmRiteshKoushik/db-dev/cmd"
+)
+
+func TestShell(t *testing.T) {
+    db := &cmd.DB{Path: filepath.Join(t.TempDir(), "test.db")}
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    input := `
+create table t (id int64, name bytes,
+    primary key (id));
+insert into t (id, name) values (1, 'a'), (20, 'b c');
+select id, name AS n
+    from t;
+.tables
+.schema t
+select nope from t;
+.bogus
+.quit
+select id from t;
+`
+    out := &strings.Builder{}
+    if err := shellRun(db, newScanInput(strings.NewReader(input), nil), out); err != nil {
+        t.Fatal(err)
+    }
+    want := `OK
+2 rows affected
+id  n
+--  -
+1   a
+20  b c
+(2 rows)
+t
+CREATE TABLE t (
+    id INT64,
+    name BYTES,
+    PRIMARY KEY (id)
+);
+error: unknown column: nope
+error: unknown command .bogus, see .help
+`
+    if out.String() != want {
+        t.Fatalf("got:\n%s\nwant:\n%s", out.String(), want)
+    }
+}
+
+// the lines longer than the default limit of bufio.Scanner
+func TestShellLongLine(t *testing.T) {
+    db := &cmd.DB{Path: filepath.Join(t.TempDir(), "test.db")}
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    rows := []string{}
+    for i := 0; i < 200; i++ {
+        rows = append(rows, fmt.Sprintf("(%d, '%s')", i, strings.Repeat("x", 500)))
+    }
+    input := "create table t (id int64, name bytes, primary key (id));\n" +
+        "insert into t (id, name) values " + strings.Join(rows, ", ") + ";\n"
+    out := &strings.Builder{}
+    if err := shellRun(db, newScanInput(strings.NewReader(input), nil), out); err != nil {
+        t.Fatal(err)
+    }
+    if out.String() != "OK\n200 rows affected\n" {
+        t.Fatalf("got %q", out.String())
+    }
+}
+
+// the line editor, the up arrow brings back the last line
+func TestShellTerm(t *testing.T) {
+    db := &cmd.DB{Path: filepath.Join(t.TempDir(), "test.db")}
+    if err := db.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    input := "create table t (id int64, primary key (id));\r" +
+        "\x1b[A\r" + // the same again
+        "\x04" // ^D
+    out := &bytes.Buffer{}
+    tm := term.NewTerminal(struct {
+        io.Reader
+        io.Writer
+    }{strings.NewReader(input), out}, "")
+    if err := shellRun(db, &termInput{t: tm}, tm); err != nil {
+        t.Fatal(err)
+    }
+    got := out.String()
+    if !strings.Contains(got, "OK\r\n") || !strings.Contains(got, "error: table exists: t\r\n") {
+        t.Fatalf("got %q", got)
+    }
+}
+
+func TestValueStr(t *testing.T) {
+    cases := map[string]cmd.Value{
+        "-5": {Type: cmd.TYPE_INT64, I64: -5},
+        "héllo": {Type: cmd.TYPE_BYTES, Str: []byte("héllo")},
+        `"a\tb"`: {Type: cmd.TYPE_BYTES, Str: []byte("a\tb")},
+        `"\xff"`: {Type: cmd.TYPE_BYTES, Str: []byte{0xff}},
+    }
+    for want, val := range cases {
+        if got := valueStr(val); got != want {
+            t.Fatalf("got %s, want %s", got, want)
+        }
+    }
+}